@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// UserConfig is the per-user setting kept in ~/.live/config.json. Server is
+// empty for the public upload service.
+type UserConfig struct {
+	Server string `json:"server,omitempty"`
+	User   string `json:"user"`
+	Token  string `json:"token"`
+}
+
+type UserResponse struct {
+	Name string `json:"name"`
+}
+
+type VisibilityRequest struct {
+	Visibility string `json:"visibility"`
+}
+
+const DEFAULT_API_URL = "https://live-coding-api.takukitamura.com"
+const USER_CONFIG = ".live/config.json"
+
+func userConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, filepath.FromSlash(USER_CONFIG)), nil
+}
+
+func loadUserConfig() (UserConfig, error) {
+	config := UserConfig{}
+	path, err := userConfigPath()
+	if err != nil {
+		return config, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// saveUserConfig writes the config readable by the user only, since it
+// holds the token.
+func saveUserConfig(config UserConfig) error {
+	path, err := userConfigPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func (config UserConfig) apiURL(path string) string {
+	server := DEFAULT_API_URL
+	if config.Server != "" {
+		server = strings.TrimSuffix(config.Server, "/")
+	}
+	return server + path
+}
+
+// apiRequest calls the upload service with the user's token. A response
+// other than 200 is returned as an error with the server's message.
+func apiRequest(config UserConfig, method string, path string, body io.Reader, contentType string) ([]byte, error) {
+	req, err := http.NewRequest(method, config.apiURL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusOK {
+		return bodyBytes, nil
+	}
+	errorsResponse := ErrorsResponse{}
+	if err := json.Unmarshal(bodyBytes, &errorsResponse); err != nil || len(errorsResponse) != 1 {
+		return nil, errors.New("error code " + res.Status + " is unknown")
+	}
+	return nil, errors.New(errorsResponse[0].Message)
+}
+
+// loggedInUser returns the user config, or an error telling to log in.
+func loggedInUser() (UserConfig, error) {
+	config, err := loadUserConfig()
+	if err != nil {
+		return config, err
+	}
+	if config.Token == "" {
+		return config, errors.New("you should login before, run \"live login\".")
+	}
+	return config, nil
+}
+
+// readSecret reads a line without echoing it. Ctrl-C gives an empty line.
+func readSecret(prompt string) string {
+	fmt.Print(prompt)
+	noEcho := exec.Command("stty", "-echo")
+	noEcho.Stdin = os.Stdin
+	if noEcho.Run() == nil {
+		defer func() {
+			echo := exec.Command("stty", "echo")
+			echo.Stdin = os.Stdin
+			echo.Run()
+			fmt.Println()
+		}()
+	}
+	line, _ := readLine(interrupted())
+	return strings.TrimSpace(line)
+}
+
+// live login [--server url]
+func liveLogin(args []string, projectPath string) {
+	args, server, _ := flagValue(args, "--server")
+	if len(args) != 0 {
+		writeCommandOut("usage: live login [--server url]\n", projectPath, false)
+		return
+	}
+
+	config := UserConfig{Server: server}
+	writeCommandOut("open "+config.apiURL("/settings/tokens")+" in your browser, create a token and paste it here.\n", projectPath, false)
+	config.Token = readSecret("token: ")
+	if config.Token == "" {
+		return
+	}
+
+	body, err := apiRequest(config, "GET", "/api/user", nil, "")
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	user := UserResponse{}
+	if err := json.Unmarshal(body, &user); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	config.User = user.Name
+	if err := saveUserConfig(config); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut("logged in as "+user.Name+".\n", projectPath, false)
+}
+
+// uploadedProjectName is the project named in args, or the current one.
+func uploadedProjectName(args []string, projectPath string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	_, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(root), nil
+}
+
+// live unpublish [project]
+func liveUnpublish(args []string, projectPath string) {
+	if len(args) > 1 {
+		writeCommandOut("usage: live unpublish [project]\n", projectPath, false)
+		return
+	}
+	config, err := loggedInUser()
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	projectName, err := uploadedProjectName(args, projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if !confirm("unpublish " + projectName + "?") {
+		return
+	}
+	if _, err := apiRequest(config, "DELETE", "/api/live/projects/"+url.PathEscape(projectName), nil, ""); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut(projectName+" is unpublished.\n", projectPath, false)
+}
+
+// live visibility private|public [project]
+func liveVisibility(args []string, projectPath string) {
+	if len(args) == 0 || len(args) > 2 || (args[0] != "private" && args[0] != "public") {
+		writeCommandOut("usage: live visibility private|public [project]\n", projectPath, false)
+		return
+	}
+	config, err := loggedInUser()
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	projectName, err := uploadedProjectName(args[1:], projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	data, err := json.Marshal(VisibilityRequest{Visibility: args[0]})
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if _, err := apiRequest(config, "PUT", "/api/live/projects/"+url.PathEscape(projectName)+"/visibility", bytes.NewReader(data), "application/json"); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut(projectName+" is "+args[0]+".\n", projectPath, false)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// checkoutSnapshot writes the tree of snapshot s into dir, replacing what
+// was there. The project's own work tree is never touched.
+func checkoutSnapshot(r *git.Repository, s Snapshot, dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	c, err := snapshotCommit(r, s)
+	if err != nil {
+		return err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return err
+	}
+	return tree.Files().ForEach(func(f *object.File) error {
+		path := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			mode = 0644
+		}
+		reader, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(file, reader)
+		return err
+	})
+}
+
+// DEFAULT_BISECT_TIMEOUT is how many seconds the command may run in one
+// snapshot before it is killed and the snapshot counted as failing.
+const DEFAULT_BISECT_TIMEOUT = 60
+
+// runInSnapshot runs command in a checkout of s and reports whether it
+// passed and whether it was killed for running longer than timeout.
+// Ctrl-C kills it and stops the bisect.
+func runInSnapshot(r *git.Repository, s Snapshot, dir string, command string, timeout time.Duration) (bool, bool, error) {
+	if err := checkoutSnapshot(r, s, dir); err != nil {
+		return false, false, err
+	}
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = dir
+	timedOut, err := runWithTimeout(cmd, timeout, interrupted())
+	if timedOut {
+		return false, true, nil
+	}
+	if err != nil && exitCode(err) == -1 {
+		return false, false, err
+	}
+	return err == nil, false, nil
+}
+
+// bisectSnapshots returns the first snapshot after good for which command
+// fails, checking that good passes and the last snapshot fails. A command
+// still running after timeout fails.
+func bisectSnapshots(r *git.Repository, snapshots Snapshots, good int, command string, timeout time.Duration, progress func(string)) (int, error) {
+	dir, err := ioutil.TempDir("", "live-bisect")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	check := func(id int) (bool, error) {
+		passed, timedOut, err := runInSnapshot(r, snapshots[id], dir, command, timeout)
+		if err != nil {
+			return false, err
+		}
+		result := "fail"
+		if passed {
+			result = "pass"
+		} else if timedOut {
+			result = "fail (timed out after " + timeout.String() + ")"
+		}
+		progress("ID " + strconv.Itoa(id) + ": " + result + "\n")
+		return passed, nil
+	}
+
+	bad := len(snapshots) - 1
+	passed, err := check(bad)
+	if err != nil {
+		return 0, err
+	}
+	if passed {
+		return 0, errors.New("the latest snapshot passes, nothing to bisect")
+	}
+	passed, err = check(good)
+	if err != nil {
+		return 0, err
+	}
+	if !passed {
+		return 0, errors.New("snapshot " + strconv.Itoa(good) + " fails too, give an older passing one with --good")
+	}
+
+	for bad-good > 1 {
+		mid := (good + bad) / 2
+		passed, err := check(mid)
+		if err != nil {
+			return 0, err
+		}
+		if passed {
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+	return bad, nil
+}
+
+// live bisect [--good id] [--timeout seconds] <command>
+func liveBisect(args []string, projectPath string) {
+	args, goodValue, _ := flagValue(args, "--good")
+	args, timeoutValue, _ := flagValue(args, "--timeout")
+	if len(args) == 0 {
+		writeCommandOut("usage: live bisect [--good id] [--timeout seconds] <command>\n", projectPath, false)
+		return
+	}
+	command := strings.Join(args, " ")
+	timeout := DEFAULT_BISECT_TIMEOUT
+	if timeoutValue != "" {
+		t, err := strconv.Atoi(timeoutValue)
+		if err != nil || t <= 0 {
+			writeCommandOut("timeout is invalid.\n", projectPath, false)
+			return
+		}
+		timeout = t
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if len(snapshots) < 2 {
+		writeCommandOut("there are not enough snapshots to bisect.\n", projectPath, false)
+		return
+	}
+
+	good := 0
+	if goodValue != "" {
+		good, err = parseSnapshotID(goodValue, snapshots)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+	}
+
+	progress := func(out string) {
+		writeCommandOut(out, projectPath, false)
+	}
+	id, err := bisectSnapshots(r, snapshots, good, command, time.Duration(timeout)*time.Second, progress)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	update, err := snapshotUpdate(r, snapshots, id)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	out := "first failing snapshot is ID " + strconv.Itoa(id) + " (" + time.Unix(0, snapshots[id].Time).Format("2006-01-02 15:04:05") + ")\n"
+	for _, line := range strings.Split(update.Diff, "\n") {
+		if strings.HasPrefix(line, "+") {
+			out += "\x1b[32m" + line + "\x1b[0m\n"
+		} else if strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "--- ") {
+			out += "\x1b[31m" + line + "\x1b[0m\n"
+		} else {
+			out += line + "\n"
+		}
+	}
+	writeCommandOut(out, projectPath, false)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/utils/diff"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// BlameLine is one line of "live blame". Rewrites is how many times the line
+// was changed in place during the session, which is also used as its heat.
+// ID is -1 for a line from a commit that is not one of the snapshots.
+type BlameLine struct {
+	Line     int    `json:"line"`
+	Text     string `json:"text"`
+	ID       int    `json:"id"`
+	Hash     string `json:"hash"`
+	Time     int64  `json:"time"`
+	Rewrites int    `json:"rewrites"`
+	Author   string `json:"author,omitempty"`
+}
+
+type BlameLines []BlameLine
+
+func countLines(text string) int {
+	n := strings.Count(text, "\n")
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		n++
+	}
+	return n
+}
+
+// lineChurn follows path through the snapshots and counts, for every line
+// of the last version, how many times it has been rewritten.
+func lineChurn(r *git.Repository, snapshots Snapshots, path string) ([]int, error) {
+	counts := []int{}
+	prev := ""
+	for _, s := range snapshots {
+		cur, err := snapshotFile(r, s, path)
+		if err != nil {
+			return nil, err
+		}
+		if cur == prev {
+			continue
+		}
+		counts = churnStep(counts, prev, cur)
+		prev = cur
+	}
+	return counts, nil
+}
+
+// churnStep carries the rewrite counts of the lines of prev over to cur. A
+// line that replaces a deleted one counts one more rewrite than it.
+func churnStep(counts []int, prev string, cur string) []int {
+	next := []int{}
+	deleted := []int{}
+	line := 0
+	for _, d := range diff.Do(prev, cur) {
+		n := countLines(d.Text)
+		if line+n > len(counts) {
+			n = len(counts) - line
+		}
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			next = append(next, counts[line:line+n]...)
+			line += n
+			deleted = deleted[:0]
+		case diffmatchpatch.DiffDelete:
+			deleted = append(deleted, counts[line:line+n]...)
+			line += n
+		case diffmatchpatch.DiffInsert:
+			n = countLines(d.Text)
+			for i := 0; i < n; i++ {
+				if i < len(deleted) {
+					next = append(next, deleted[i]+1)
+				} else {
+					next = append(next, 0)
+				}
+			}
+			deleted = deleted[:0]
+		}
+	}
+	return next
+}
+
+// blameSnapshot returns the blame of path as of snapshot id.
+func blameSnapshot(r *git.Repository, snapshots Snapshots, path string, id int) (BlameLines, error) {
+	c, err := snapshotCommit(r, snapshots[id])
+	if err != nil {
+		return nil, err
+	}
+	result, err := git.Blame(c, path)
+	if err != nil {
+		return nil, err
+	}
+
+	churn, err := lineChurn(r, snapshots[:id+1], path)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[string]int{}
+	for _, s := range snapshots[:id+1] {
+		ids[s.Hash] = s.ID
+	}
+
+	lines := BlameLines{}
+	for i, l := range result.Lines {
+		line := BlameLine{
+			Line: i + 1,
+			Text: l.Text,
+			ID:   -1,
+			Hash: l.Hash.String(),
+			Time: l.Date.UnixNano(),
+		}
+		if i < len(churn) {
+			line.Rewrites = churn[i]
+		}
+		if s, ok := ids[l.Hash.String()]; ok {
+			line.ID = s
+			line.Time = snapshots[s].Time
+			line.Author = snapshots[s].Author
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// heatLevel is 0 for a line never rewritten, up to 3 for one rewritten
+// five times or more.
+func heatLevel(rewrites int) int {
+	if rewrites >= 5 {
+		return 3
+	} else if rewrites >= 2 {
+		return 2
+	} else if rewrites == 1 {
+		return 1
+	}
+	return 0
+}
+
+func heatColor(rewrites int) string {
+	return []string{"", "\x1b[32m", "\x1b[33m", "\x1b[31m"}[heatLevel(rewrites)]
+}
+
+// live blame <file> [@id] [--json]
+func liveBlame(args []string, projectPath string) {
+	args, jsonOutput := hasFlag(args, "--json")
+	if len(args) != 1 && len(args) != 2 {
+		writeCommandOut("usage: live blame <file> [@id] [--json]\n", projectPath, false)
+		return
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	id := len(snapshots) - 1
+	if len(args) == 2 {
+		id, err = parseSnapshotID(args[1], snapshots)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+	}
+
+	path, err := projectRelPath(root, args[0])
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	lines, err := blameSnapshot(r, snapshots, path, id)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	if jsonOutput {
+		data, err := json.Marshal(lines)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		writeCommandOut(string(data)+"\n", projectPath, false)
+		return
+	}
+
+	width := 0
+	for _, l := range lines {
+		if len(l.Author) > width {
+			width = len(l.Author)
+		}
+	}
+	out := ""
+	for _, l := range lines {
+		author := ""
+		if width > 0 {
+			author = fmt.Sprintf(" %-*s", width, l.Author)
+		}
+		id := "?"
+		if l.ID >= 0 {
+			id = strconv.Itoa(l.ID)
+		}
+		out += fmt.Sprintf("%s%5s %s%s %3dx\x1b[0m %4d| %s\n", heatColor(l.Rewrites), id, formatSnapshotTime(l.Time), author, l.Rewrites, l.Line, l.Text)
+	}
+	writeCommandOut(out, projectPath, false)
+}
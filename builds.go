@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildResult is attached to the command event of a build or test run.
+type BuildResult struct {
+	Name    string   `json:"name"`
+	Passed  bool     `json:"passed"`
+	Failed  []string `json:"failed,omitempty"`
+	Summary string   `json:"summary,omitempty"`
+}
+
+// lastBuild is the most recent build result, shown on the counter page.
+// Builds are recorded from the prompt and from the kata runner, so it is
+// only used under lastBuildMutex.
+var lastBuild *BuildResult
+var lastBuildMutex sync.Mutex
+
+func latestBuild() *BuildResult {
+	lastBuildMutex.Lock()
+	defer lastBuildMutex.Unlock()
+	return lastBuild
+}
+
+func setLastBuild(b *BuildResult) {
+	lastBuildMutex.Lock()
+	lastBuild = b
+	lastBuildMutex.Unlock()
+}
+
+var goTestFailRegexp = regexp.MustCompile(`^\s*--- FAIL: (\S+)`)
+var goTestPassRegexp = regexp.MustCompile(`^\s*--- PASS: (\S+)`)
+var goBuildFailRegexp = regexp.MustCompile(`^FAIL\s+(\S+)\s+\[(build|setup) failed\]`)
+
+type goTestEvent struct {
+	Action  string `json:"Action"`
+	Package string `json:"Package"`
+	Test    string `json:"Test"`
+}
+
+// parseGoTestOutput reads both "go test" and "go test -json" output and
+// returns the failing tests and the number of passing ones.
+func parseGoTestOutput(out string) ([]string, int) {
+	failed := []string{}
+	passed := 0
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "{") {
+			e := goTestEvent{}
+			if err := json.Unmarshal([]byte(line), &e); err == nil {
+				if e.Test == "" {
+					continue
+				}
+				if e.Action == "fail" {
+					failed = append(failed, e.Test)
+				} else if e.Action == "pass" {
+					passed++
+				}
+				continue
+			}
+		}
+		if m := goTestFailRegexp.FindStringSubmatch(line); m != nil {
+			failed = append(failed, m[1])
+		} else if m := goTestPassRegexp.FindStringSubmatch(line); m != nil {
+			passed++
+		} else if m := goBuildFailRegexp.FindStringSubmatch(line); m != nil {
+			failed = append(failed, m[1]+" ["+m[2]+" failed]")
+		}
+	}
+	return failed, passed
+}
+
+func lastLine(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	line := strings.TrimSpace(lines[len(lines)-1])
+	if len(line) > 200 {
+		line = line[:200]
+	}
+	return line
+}
+
+func newBuildResult(pattern *BuildPattern, out string, code int) *BuildResult {
+	result := &BuildResult{
+		Name:   pattern.Name,
+		Passed: code == 0,
+	}
+	result.Summary = lastLine(out)
+	if pattern.Format == "go-test" {
+		failed, passed := parseGoTestOutput(out)
+		result.Failed = failed
+		if passed != 0 || len(failed) != 0 {
+			result.Summary = strconv.Itoa(passed) + " passed, " + strconv.Itoa(len(failed)) + " failed"
+		}
+	}
+	return result
+}
+
+func counterMessage(id int) string {
+	message := "ID: " + strconv.Itoa(id)
+	if b := latestBuild(); b != nil && b.Passed {
+		message += ` <span style="color:#2a2">&#x25cf;</span>`
+	} else if b != nil {
+		message += ` <span style="color:#d22">&#x25cf;</span>`
+	}
+	if isLiveStarted() && isPaused() {
+		message += `<span style="display:block;font-size:0.4em;color:#888">paused</span>`
+	}
+	if k := currentKata(); k != nil {
+		message += k.countdown()
+	}
+	return message
+}
+
+// recordCommand writes a finished shell command to the event log. If it
+// matches one of the project's build patterns its result is attached to
+// snapshot, the one in effect when the command started, and shown on the
+// counter page.
+func recordCommand(line string, out string, err error, snapshot int, duration time.Duration, projectPath string, couterHTMLPath string, liveStart bool) {
+	if liveStart == false {
+		return
+	}
+
+	event := Event{
+		Time:     time.Now().UnixNano(),
+		Type:     "command",
+		Snapshot: snapshot,
+		Command:  line,
+		ExitCode: exitCode(err),
+		Duration: duration.Nanoseconds(),
+	}
+
+	config, err := loadProjectConfig(projectPath)
+	if err != nil {
+		writeCommandOut(PROJECT_CONFIG+": "+err.Error()+"\n", projectPath, liveStart)
+	} else if pattern := config.matchBuild(line); pattern != nil {
+		event.Build = newBuildResult(pattern, out, event.ExitCode)
+		setLastBuild(event.Build)
+		if err, _ := createCounterHTML(counterMessage(snapshotID()), couterHTMLPath); err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+		}
+	}
+
+	writeEvent(event, projectPath, liveStart)
+}
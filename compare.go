@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/utils/diff"
+)
+
+// CompareSession is one side of "live compare". Start is the first
+// snapshot or event, every time shown is elapsed from it.
+type CompareSession struct {
+	Name      string
+	r         *git.Repository
+	Snapshots Snapshots
+	Events    Events
+	Stats     SessionStats
+	Start     int64
+	Files     map[string]string
+}
+
+type SessionSummary struct {
+	Name              string  `json:"name"`
+	Snapshots         int     `json:"snapshots"`
+	DurationSeconds   float64 `json:"duration_seconds"`
+	ActiveSeconds     float64 `json:"active_seconds"`
+	FirstGreenSeconds float64 `json:"first_green_seconds"`
+	LinesAdded        int     `json:"lines_added"`
+	LinesRemoved      int     `json:"lines_removed"`
+	Files             int     `json:"files"`
+	Lines             int     `json:"lines"`
+}
+
+// FileComparison is a file of either final tree. Lines is -1 on the side
+// the file is missing from, Added and Removed count the lines from the
+// first session to the second.
+type FileComparison struct {
+	Path    string `json:"path"`
+	Lines   [2]int `json:"lines"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+type MarkerAlignment struct {
+	Label   string     `json:"label"`
+	Seconds [2]float64 `json:"seconds"`
+}
+
+type CompareReport struct {
+	Align    string            `json:"align"`
+	Sessions [2]SessionSummary `json:"sessions"`
+	Markers  []MarkerAlignment `json:"markers"`
+	Files    []FileComparison  `json:"files"`
+}
+
+// Alignment maps the elapsed time of both sessions onto one timeline.
+// Anchors are the elapsed times of the same moment in each session, and
+// the stretch between two anchors lasts as long as the longer of the two.
+type Alignment struct {
+	Anchors   [][2]int64
+	Positions []int64
+}
+
+const COMPARE_ALIGN_TIME = "time"
+const COMPARE_ALIGN_MARKER = "marker"
+const COMPARE_TERMINAL_LINES = 12
+
+func openCompareSession(path string) (*CompareSession, func(), error) {
+	r, root, cleanup, err := openSessionPath(path)
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	s := &CompareSession{Name: filepath.Base(root), r: r, Files: map[string]string{}}
+	if s.Snapshots, err = loadSnapshotIndex(s.r, root); err != nil {
+		return nil, cleanup, err
+	}
+	if s.Events, err = readEvents(root); err != nil {
+		return nil, cleanup, err
+	}
+	if s.Stats, err = computeStats(s.r, s.Snapshots, s.Events, DEFAULT_IDLE_SECONDS*time.Second); err != nil {
+		return nil, cleanup, err
+	}
+	s.Start = s.Stats.Start
+
+	treeFiles, err := snapshotTreeFiles(s.r, s.Snapshots[len(s.Snapshots)-1])
+	if err != nil {
+		return nil, cleanup, err
+	}
+	for name, f := range treeFiles {
+		if name == CUI_LOG {
+			continue
+		}
+		if s.Files[name], err = f.Contents(); err != nil {
+			return nil, cleanup, err
+		}
+	}
+	return s, cleanup, nil
+}
+
+func (s *CompareSession) elapsed(t int64) int64 {
+	return t - s.Start
+}
+
+// firstGreen is the elapsed time of the first passing run of a build whose
+// name has "test" in it, or -1.
+func (s *CompareSession) firstGreen() int64 {
+	for _, e := range s.Events {
+		if e.Build != nil && e.Build.Passed && strings.Contains(e.Build.Name, "test") {
+			return s.elapsed(e.Time)
+		}
+	}
+	return -1
+}
+
+func (s *CompareSession) summary() SessionSummary {
+	summary := SessionSummary{
+		Name:              s.Name,
+		Snapshots:         len(s.Snapshots),
+		DurationSeconds:   time.Duration(s.Stats.End - s.Stats.Start).Seconds(),
+		ActiveSeconds:     s.Stats.ActiveSeconds,
+		FirstGreenSeconds: -1,
+		LinesAdded:        s.Stats.LinesAdded,
+		LinesRemoved:      s.Stats.LinesRemoved,
+		Files:             len(s.Files),
+	}
+	if green := s.firstGreen(); green >= 0 {
+		summary.FirstGreenSeconds = time.Duration(green).Seconds()
+	}
+	for _, contents := range s.Files {
+		summary.Lines += countLines(contents)
+	}
+	return summary
+}
+
+// commonMarkers pairs the markers of both sessions that have the same
+// label, in order.
+func commonMarkers(a *CompareSession, b *CompareSession) []MarkerAlignment {
+	result := []MarkerAlignment{}
+	markersB := sessionMarkers(b.Events)
+	next := 0
+	for _, ma := range sessionMarkers(a.Events) {
+		for j := next; j < len(markersB); j++ {
+			if markersB[j].Label == ma.Label {
+				result = append(result, MarkerAlignment{
+					Label:   ma.Label,
+					Seconds: [2]float64{time.Duration(a.elapsed(ma.Time)).Seconds(), time.Duration(b.elapsed(markersB[j].Time)).Seconds()},
+				})
+				next = j + 1
+				break
+			}
+		}
+	}
+	return result
+}
+
+func alignSessions(a *CompareSession, b *CompareSession, markers []MarkerAlignment, align string) Alignment {
+	alignment := Alignment{Anchors: [][2]int64{{0, 0}}, Positions: []int64{0}}
+	add := func(ta int64, tb int64) {
+		last := alignment.Anchors[len(alignment.Anchors)-1]
+		if ta < last[0] || tb < last[1] {
+			return
+		}
+		length := ta - last[0]
+		if tb-last[1] > length {
+			length = tb - last[1]
+		}
+		alignment.Anchors = append(alignment.Anchors, [2]int64{ta, tb})
+		alignment.Positions = append(alignment.Positions, alignment.Positions[len(alignment.Positions)-1]+length)
+	}
+	if align == COMPARE_ALIGN_MARKER {
+		for _, m := range markers {
+			add(int64(m.Seconds[0]*float64(time.Second)), int64(m.Seconds[1]*float64(time.Second)))
+		}
+	}
+	add(a.elapsed(a.Stats.End), b.elapsed(b.Stats.End))
+	return alignment
+}
+
+// position is where the elapsed time t of session side lies on the shared
+// timeline. Aligned by time, it is t itself.
+func (alignment Alignment) position(side int, t int64, align string) int64 {
+	if align != COMPARE_ALIGN_MARKER {
+		return t
+	}
+	for k := 1; k < len(alignment.Anchors); k++ {
+		from, to := alignment.Anchors[k-1][side], alignment.Anchors[k][side]
+		if t > to && k < len(alignment.Anchors)-1 {
+			continue
+		}
+		if to == from {
+			return alignment.Positions[k-1]
+		}
+		scale := float64(alignment.Positions[k]-alignment.Positions[k-1]) / float64(to-from)
+		return alignment.Positions[k-1] + int64(float64(t-from)*scale)
+	}
+	return t
+}
+
+func compareFiles(a *CompareSession, b *CompareSession) []FileComparison {
+	paths := map[string]bool{}
+	for path := range a.Files {
+		paths[path] = true
+	}
+	for path := range b.Files {
+		paths[path] = true
+	}
+
+	result := []FileComparison{}
+	for path := range paths {
+		f := FileComparison{Path: path, Lines: [2]int{-1, -1}}
+		contentsA, okA := a.Files[path]
+		contentsB, okB := b.Files[path]
+		if okA {
+			f.Lines[0] = countLines(contentsA)
+		}
+		if okB {
+			f.Lines[1] = countLines(contentsB)
+		}
+		for _, d := range diff.Do(contentsA, contentsB) {
+			switch d.Type {
+			case diffmatchpatch.DiffInsert:
+				f.Added += countLines(d.Text)
+			case diffmatchpatch.DiffDelete:
+				f.Removed += countLines(d.Text)
+			}
+		}
+		result = append(result, f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+func formatElapsed(seconds float64) string {
+	if seconds < 0 {
+		return "-"
+	}
+	return formatSeconds(seconds)
+}
+
+func compareTable(report CompareReport) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	a, b := report.Sessions[0], report.Sessions[1]
+
+	fmt.Fprintf(w, "\t%s\t%s\n", a.Name, b.Name)
+	fmt.Fprintf(w, "snapshots\t%d\t%d\n", a.Snapshots, b.Snapshots)
+	fmt.Fprintf(w, "duration\t%s\t%s\n", formatElapsed(a.DurationSeconds), formatElapsed(b.DurationSeconds))
+	fmt.Fprintf(w, "active\t%s\t%s\n", formatElapsed(a.ActiveSeconds), formatElapsed(b.ActiveSeconds))
+	fmt.Fprintf(w, "first green test\t%s\t%s\n", formatElapsed(a.FirstGreenSeconds), formatElapsed(b.FirstGreenSeconds))
+	fmt.Fprintf(w, "churn\t+%d -%d\t+%d -%d\n", a.LinesAdded, a.LinesRemoved, b.LinesAdded, b.LinesRemoved)
+	fmt.Fprintf(w, "final tree\t%d files, %d lines\t%d files, %d lines\n", a.Files, a.Lines, b.Files, b.Lines)
+
+	if len(report.Markers) > 0 {
+		fmt.Fprintf(w, "\nMARKER\t%s\t%s\n", a.Name, b.Name)
+		for _, m := range report.Markers {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", m.Label, formatElapsed(m.Seconds[0]), formatElapsed(m.Seconds[1]))
+		}
+	}
+
+	lines := func(n int) string {
+		if n < 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%d", n)
+	}
+	fmt.Fprintf(w, "\nFILE\t%s\t%s\tDIFF\n", a.Name, b.Name)
+	for _, f := range report.Files {
+		change := "same"
+		if f.Added != 0 || f.Removed != 0 {
+			change = fmt.Sprintf("+%d -%d", f.Added, f.Removed)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Path, lines(f.Lines[0]), lines(f.Lines[1]), change)
+	}
+
+	w.Flush()
+	return buf.String()
+}
+
+// CompareFrame is a snapshot of one side of the HTML replay. Text and
+// Terminal index the shared texts.
+type CompareFrame struct {
+	Position int64  `json:"t"`
+	ID       int    `json:"id"`
+	File     string `json:"file"`
+	Text     int    `json:"text"`
+	Changed  []int  `json:"changed"`
+	Terminal int    `json:"terminal"`
+	Marker   string `json:"marker,omitempty"`
+}
+
+type CompareReplay struct {
+	Align    string            `json:"align"`
+	Names    [2]string         `json:"names"`
+	Duration int64             `json:"duration"`
+	Markers  []int64           `json:"markers"`
+	Labels   []string          `json:"labels"`
+	Frames   [2][]CompareFrame `json:"frames"`
+	Texts    []string          `json:"texts"`
+}
+
+func compareReplay(sessions [2]*CompareSession, report CompareReport, alignment Alignment) (CompareReplay, error) {
+	replay := CompareReplay{Align: report.Align, Markers: []int64{}, Labels: []string{}, Texts: []string{}}
+	texts := map[string]int{}
+	text := func(s string) int {
+		if i, ok := texts[s]; ok {
+			return i
+		}
+		texts[s] = len(replay.Texts)
+		replay.Texts = append(replay.Texts, s)
+		return texts[s]
+	}
+
+	for side, s := range sessions {
+		replay.Names[side] = s.Name
+		replay.Frames[side] = []CompareFrame{}
+		for id, snapshot := range s.Snapshots {
+			frame, err := replayFrame(s.r, s.Snapshots, s.Events, id)
+			if err != nil {
+				return replay, err
+			}
+			changed := []int{}
+			for line := range frame.Changed {
+				changed = append(changed, line)
+			}
+			sort.Ints(changed)
+			terminal := frame.Terminal
+			if len(terminal) > COMPARE_TERMINAL_LINES {
+				terminal = terminal[len(terminal)-COMPARE_TERMINAL_LINES:]
+			}
+			position := alignment.position(side, s.elapsed(snapshot.Time), report.Align)
+			replay.Frames[side] = append(replay.Frames[side], CompareFrame{
+				Position: position,
+				ID:       id,
+				File:     frame.File,
+				Text:     text(strings.Join(frame.Lines, "\n")),
+				Changed:  changed,
+				Terminal: text(strings.Join(terminal, "\n")),
+				Marker:   frame.MarkerLabel,
+			})
+			if position > replay.Duration {
+				replay.Duration = position
+			}
+		}
+	}
+	for _, m := range report.Markers {
+		replay.Markers = append(replay.Markers, alignment.position(0, int64(m.Seconds[0]*float64(time.Second)), report.Align))
+		replay.Labels = append(replay.Labels, m.Label)
+	}
+	return replay, nil
+}
+
+func compareHTML(replay CompareReplay) (string, error) {
+	data, err := json.Marshal(replay)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(compareHTMLTemplate, "{{DATA}}", string(data), 1), nil
+}
+
+// live compare <a> <b> [--align time|marker] [--json] [-o file.html]
+func liveCompare(args []string, projectPath string) {
+	args, jsonOutput := hasFlag(args, "--json")
+	args, align, _ := flagValue(args, "--align")
+	args, outputPath, _ := flagValue(args, "-o")
+	if align == "" {
+		align = COMPARE_ALIGN_TIME
+	}
+	if len(args) != 2 || (align != COMPARE_ALIGN_TIME && align != COMPARE_ALIGN_MARKER) {
+		writeCommandOut("usage: live compare <project or archive> <project or archive> [--align time|marker] [--json] [-o file.html]\n", projectPath, false)
+		return
+	}
+
+	sessions := [2]*CompareSession{}
+	for i, path := range args {
+		s, cleanup, err := openCompareSession(path)
+		defer cleanup()
+		if err != nil {
+			writeCommandOut(path+": "+err.Error()+"\n", projectPath, false)
+			return
+		}
+		sessions[i] = s
+	}
+
+	report := CompareReport{
+		Align:    align,
+		Sessions: [2]SessionSummary{sessions[0].summary(), sessions[1].summary()},
+		Markers:  commonMarkers(sessions[0], sessions[1]),
+		Files:    compareFiles(sessions[0], sessions[1]),
+	}
+	if align == COMPARE_ALIGN_MARKER && len(report.Markers) == 0 {
+		writeCommandOut("the sessions have no marker in common, aligned by time.\n", projectPath, false)
+		report.Align = COMPARE_ALIGN_TIME
+	}
+
+	if jsonOutput {
+		data, err := json.Marshal(report)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		writeCommandOut(string(data)+"\n", projectPath, false)
+	} else {
+		writeCommandOut(compareTable(report), projectPath, false)
+	}
+	if outputPath == "" {
+		return
+	}
+
+	alignment := alignSessions(sessions[0], sessions[1], report.Markers, report.Align)
+	replay, err := compareReplay(sessions, report, alignment)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	out, err := compareHTML(replay)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if err := ioutil.WriteFile(outputPath, []byte(out), 0644); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut("wrote "+outputPath+".\n", projectPath, false)
+}
+
+// compareHTMLTemplate shows both sessions next to each other. The slider
+// moves along the shared timeline and each side shows its latest snapshot
+// at that point.
+const compareHTMLTemplate = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>LiveCoding compare</title>
+<style>
+body{margin:0;font-family:sans-serif;display:grid;grid-template-columns:1fr 1fr;grid-template-rows:auto 1fr 30%;height:100vh}
+header{grid-column:1/3;background:#222;color:#eee;padding:6px 10px}
+header input[type=range]{width:60%;vertical-align:middle}
+#markers button{margin:2px;font-size:12px}
+.title{font-weight:bold;padding:4px 8px;background:#eee;border-bottom:1px solid #ccc}
+.side{display:flex;flex-direction:column;overflow:hidden;border-right:1px solid #ccc}
+.code{flex:1;overflow:auto;margin:0;padding:8px;font-size:13px}
+.code div{white-space:pre;min-height:1em}.add{background:#dfd}
+.terminal{overflow:auto;margin:0;padding:8px;background:#111;color:#ddd;font-size:13px}
+</style></head><body>
+<header><button id="play">play</button> <input id="slider" type="range" min="0" value="0"> <span id="clock"></span> <select id="speed"><option>1</option><option>2</option><option selected>5</option><option>10</option><option>30</option></select>x
+<div id="markers"></div></header>
+<div class="side"><div class="title" id="title0"></div><pre class="code" id="code0"></pre></div>
+<div class="side"><div class="title" id="title1"></div><pre class="code" id="code1"></pre></div>
+<pre class="terminal" id="terminal0"></pre><pre class="terminal" id="terminal1"></pre>
+<script id="data" type="application/json">{{DATA}}</script>
+<script>
+var D=JSON.parse(document.getElementById("data").textContent);
+var slider=document.getElementById("slider"),playing=null,shown=[-1,-1];
+slider.max=D.duration;
+function esc(s){return s.replace(/&/g,"&amp;").replace(/</g,"&lt;")}
+function clock(t){var s=Math.floor(t/1e9);return Math.floor(s/60)+":"+("0"+s%60).slice(-2)}
+function frameAt(side,t){var fs=D.frames[side],f=-1;for(var i=0;i<fs.length&&fs[i].t<=t;i++)f=i;return f}
+function show(t){
+  document.getElementById("clock").textContent=clock(t)+" / "+clock(D.duration)+(D.align=="marker"?" (aligned by marker)":"");
+  for(var side=0;side<2;side++){
+    var i=frameAt(side,t);if(i==shown[side])continue;shown[side]=i;
+    var title=D.names[side],code="",term="";
+    if(i>=0){var f=D.frames[side][i];
+      title+="  ID: "+f.id+"  "+f.file+(f.marker?"  ["+f.marker+"]":"");
+      code=D.texts[f.text].split("\n").map(function(l,n){return '<div'+(f.changed.indexOf(n)>=0?' class="add"':'')+'>'+esc(l)+'</div>'}).join("");
+      term=esc(D.texts[f.terminal])}
+    document.getElementById("title"+side).textContent=title;
+    document.getElementById("code"+side).innerHTML=code;
+    var p=document.getElementById("terminal"+side);p.innerHTML=term;p.scrollTop=p.scrollHeight}
+}
+slider.oninput=function(){show(+slider.value)};
+document.getElementById("play").onclick=function(){
+  if(playing){clearInterval(playing);playing=null;this.textContent="play";return}
+  this.textContent="pause";var button=this;
+  if(+slider.value>=D.duration)slider.value=0;
+  playing=setInterval(function(){
+    var t=+slider.value+100e6*+document.getElementById("speed").value;
+    if(t>=D.duration){t=D.duration;clearInterval(playing);playing=null;button.textContent="play"}
+    slider.value=t;show(t)},100)};
+D.labels.forEach(function(l,i){var b=document.createElement("button");b.textContent=l;
+  b.onclick=function(){slider.value=D.markers[i];show(D.markers[i])};document.getElementById("markers").appendChild(b)});
+show(0);
+</script></body></html>
+`
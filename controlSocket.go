@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EditorEvent is sent by editor plugins over the control socket. Lines and
+// columns are 1-based, File is absolute or relative to the project.
+type EditorEvent struct {
+	File      string `json:"file"`
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+	EndLine   int    `json:"end_line,omitempty"`
+	EndColumn int    `json:"end_column,omitempty"`
+}
+
+// SocketRequest is one line of JSON read from the control socket. Time is
+// when an editor event happened, in Unix nanoseconds; it defaults to when
+// the request is read.
+type SocketRequest struct {
+	Type string `json:"type"`
+	Time int64  `json:"time,omitempty"`
+	EditorEvent
+}
+
+// SocketResponse answers a request. Status is only set for a "status"
+// request.
+type SocketResponse struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Status *LiveStatus `json:"status,omitempty"`
+}
+
+// CONTROL_SOCKET is created in .git/live while a live is running or armed.
+const CONTROL_SOCKET = "live.sock"
+
+var editorEventTypes = map[string]bool{
+	"cursor":    true,
+	"selection": true,
+	"active":    true,
+	"save":      true,
+}
+
+// controlListener is started and stopped from the prompt and closed by the
+// signal handler on shutdown, so it is only used under controlMutex.
+var controlListener net.Listener
+var controlMutex sync.Mutex
+
+func startControlSocket(projectPath string) error {
+	socketPath := liveDataPath(projectPath, CONTROL_SOCKET)
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return err
+	}
+	os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	controlMutex.Lock()
+	controlListener = listener
+	controlMutex.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveControlConn(conn, projectPath)
+		}
+	}()
+	return nil
+}
+
+func stopControlSocket() {
+	controlMutex.Lock()
+	listener := controlListener
+	controlListener = nil
+	controlMutex.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+func serveControlConn(conn net.Conn, projectPath string) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		req := SocketRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			encoder.Encode(SocketResponse{Error: err.Error()})
+			continue
+		}
+		encoder.Encode(handleControlRequest(req, projectPath))
+	}
+}
+
+func handleControlRequest(req SocketRequest, projectPath string) SocketResponse {
+	if req.Type == "status" {
+		status := currentLiveStatus(projectPath)
+		return SocketResponse{OK: true, Status: &status}
+	}
+	if !editorEventTypes[req.Type] {
+		return SocketResponse{Error: "unknown request type \"" + req.Type + "\""}
+	}
+	if isLiveStarted() == false {
+		return SocketResponse{Error: "live is stopped"}
+	}
+
+	editor := req.EditorEvent
+	if editor.File != "" && filepath.IsAbs(editor.File) {
+		rel, err := filepath.Rel(projectPath, editor.File)
+		if err != nil {
+			return SocketResponse{Error: err.Error()}
+		}
+		editor.File = filepath.ToSlash(rel)
+	}
+
+	t := req.Time
+	if t == 0 {
+		t = time.Now().UnixNano()
+	}
+	writeEvent(Event{Time: t, Type: req.Type, Snapshot: snapshotAt(t), Editor: &editor}, projectPath, isLiveStarted())
+	return SocketResponse{OK: true}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// DeltaOp is one operational edit. Pos is counted in runes in the text as
+// it is after the previous ops of the same Delta have been applied.
+type DeltaOp struct {
+	Pos    int    `json:"p"`
+	Insert string `json:"i,omitempty"`
+	Delete int    `json:"d,omitempty"`
+}
+
+// Delta is a change to one file between two snapshots. Applying every
+// Delta with Snapshot n, in order and leaving out any that does not apply,
+// to snapshot n gives snapshot n+1 exactly. Fix marks deltas added at
+// snapshot time to cover changes the poller did not see.
+type Delta struct {
+	Time     int64     `json:"t"`
+	Snapshot int       `json:"s"`
+	File     string    `json:"f"`
+	Ops      []DeltaOp `json:"o"`
+	Fix      bool      `json:"x,omitempty"`
+}
+
+const DELTA_LOG = "deltas.jsonl"
+const DELTA_POLL_INTERVAL = 100 * time.Millisecond
+const DELTA_MAX_FILE_SIZE = 1024 * 1024
+
+// DeltaRecorder keeps the last seen contents of the files it watches and
+// the deltas recorded since the last snapshot. It watches the files of the
+// latest snapshot and those watch() has seen change, so ignored files are
+// never read, and only reads a file again once its size or modification
+// time changes.
+type DeltaRecorder struct {
+	mutex    sync.Mutex
+	contents map[string]string
+	stamps   map[string]string
+	paths    map[string]bool
+	pending  []Delta
+	snapshot int
+}
+
+// deltaRecorder is nil unless "deltas" is enabled in the project config.
+var deltaRecorder *DeltaRecorder
+var deltaRecorderMutex sync.Mutex
+
+func currentDeltaRecorder() *DeltaRecorder {
+	deltaRecorderMutex.Lock()
+	defer deltaRecorderMutex.Unlock()
+	return deltaRecorder
+}
+
+func setDeltaRecorder(d *DeltaRecorder) {
+	deltaRecorderMutex.Lock()
+	deltaRecorder = d
+	deltaRecorderMutex.Unlock()
+}
+
+func deltaOps(from string, to string) []DeltaOp {
+	dmp := diffmatchpatch.New()
+	ops := []DeltaOp{}
+	pos := 0
+	for _, d := range dmp.DiffMain(from, to, false) {
+		n := utf8.RuneCountInString(d.Text)
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			pos += n
+		case diffmatchpatch.DiffDelete:
+			ops = append(ops, DeltaOp{Pos: pos, Delete: n})
+		case diffmatchpatch.DiffInsert:
+			ops = append(ops, DeltaOp{Pos: pos, Insert: d.Text})
+			pos += n
+		}
+	}
+	return ops
+}
+
+func applyDeltaOps(text string, ops []DeltaOp) (string, error) {
+	runes := []rune(text)
+	for _, op := range ops {
+		if op.Pos < 0 || op.Pos+op.Delete > len(runes) {
+			return "", errors.New("delta is out of range")
+		}
+		if op.Delete > 0 {
+			runes = append(runes[:op.Pos], runes[op.Pos+op.Delete:]...)
+		}
+		if op.Insert != "" {
+			insert := []rune(op.Insert)
+			runes = append(runes[:op.Pos], append(insert, runes[op.Pos:]...)...)
+		}
+	}
+	return string(runes), nil
+}
+
+func writeDelta(delta Delta, projectPath string) error {
+	file, err := os.OpenFile(liveDataPath(projectPath, DELTA_LOG), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(file, string(data))
+	return err
+}
+
+func loadDeltas(projectPath string) ([]Delta, error) {
+	deltas := []Delta{}
+	file, err := os.Open(liveDataPath(projectPath, DELTA_LOG))
+	if os.IsNotExist(err) {
+		return deltas, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		delta := Delta{}
+		if err := json.Unmarshal(scanner.Bytes(), &delta); err != nil {
+			return nil, err
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas, scanner.Err()
+}
+
+// readDeltaFile returns the stamp of path and, if it is a text file small
+// enough to poll, its contents.
+func readDeltaFile(projectPath string, path string) (string, string, bool) {
+	info, err := os.Stat(filepath.Join(projectPath, filepath.FromSlash(path)))
+	if err != nil {
+		return "", "", false
+	}
+	stamp := fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+	if !info.Mode().IsRegular() || info.Size() > DELTA_MAX_FILE_SIZE {
+		return stamp, "", false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(projectPath, filepath.FromSlash(path)))
+	if err != nil || !utf8.Valid(data) {
+		return stamp, "", false
+	}
+	return stamp, string(data), true
+}
+
+// newDeltaRecorder starts from the files of snapshot id as they are in the
+// work tree.
+func newDeltaRecorder(store SnapshotStore, projectPath string, id int) (*DeltaRecorder, error) {
+	d := &DeltaRecorder{
+		contents: map[string]string{},
+		stamps:   map[string]string{},
+		paths:    map[string]bool{},
+		snapshot: id,
+	}
+	if id >= 0 {
+		_, files, err := store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		for path := range files {
+			if path != CUI_LOG {
+				d.paths[path] = true
+			}
+		}
+	}
+	for path := range d.paths {
+		stamp, text, ok := readDeltaFile(projectPath, path)
+		d.stamps[path] = stamp
+		if ok {
+			d.contents[path] = text
+		}
+	}
+	return d, nil
+}
+
+// watchPaths adds the files watch() found changed to the polled ones.
+func (d *DeltaRecorder) watchPaths(paths []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, path := range paths {
+		if path != CUI_LOG {
+			d.paths[path] = true
+		}
+	}
+}
+
+// record reads the watched files whose stamp changed and writes a delta
+// for every one whose text changed. A file that stops being text is left
+// to the next snapshot rather than recorded as deleted. It holds
+// snapshotMutex so that no delta is numbered between a Put and the
+// verifyDeltas that follows it.
+func (d *DeltaRecorder) record(projectPath string) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	paths := []string{}
+	for path := range d.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		stamp, cur, ok := readDeltaFile(projectPath, path)
+		if stamp == d.stamps[path] {
+			continue
+		}
+		d.stamps[path] = stamp
+		if !ok && stamp != "" {
+			continue
+		}
+		prev := d.contents[path]
+		if prev == cur {
+			continue
+		}
+		delta := Delta{
+			Time:     time.Now().UnixNano(),
+			Snapshot: d.snapshot,
+			File:     path,
+			Ops:      deltaOps(prev, cur),
+		}
+		if err := writeDelta(delta, projectPath); err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		d.pending = append(d.pending, delta)
+		if ok {
+			d.contents[path] = cur
+		} else {
+			delete(d.contents, path)
+		}
+	}
+}
+
+// watch polls the watched files much more often than watch() and records
+// every change as a Delta, until the live stops or another recorder takes
+// over.
+func (d *DeltaRecorder) watch(projectPath string) {
+	for {
+		if isLiveStarted() == false || currentDeltaRecorder() != d {
+			return
+		}
+		time.Sleep(DELTA_POLL_INTERVAL)
+		d.record(projectPath)
+	}
+}
+
+// replayDelta applies delta to text the way every replay of the log does.
+// A delta that does not apply is left out; the fix delta written at the
+// next snapshot starts from the text without it.
+func replayDelta(text string, delta Delta) (string, bool) {
+	result, err := applyDeltaOps(text, delta.Ops)
+	if err != nil {
+		return text, false
+	}
+	return result, true
+}
+
+// verifyDeltas is called by watch() right after snapshot id is taken. It
+// replays the pending deltas on the previous snapshot and writes a fix
+// delta for every file that does not come out identical to the snapshot.
+func (d *DeltaRecorder) verifyDeltas(store SnapshotStore, id int, projectPath string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	_, current, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+	previous := SnapshotFiles{}
+	if id > 0 {
+		if _, previous, err = store.Get(id - 1); err != nil {
+			return err
+		}
+	}
+
+	paths := map[string]bool{}
+	for _, path := range changedFiles(previous, current) {
+		if path != CUI_LOG {
+			paths[path] = true
+		}
+	}
+	for _, delta := range d.pending {
+		paths[delta.File] = true
+	}
+	sorted := []string{}
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	for _, path := range sorted {
+		want, err := storedFile(store, current, path)
+		if err != nil {
+			return err
+		}
+		if !utf8.ValidString(want) {
+			// the next delta of a file that turns back into text starts
+			// from the snapshot, as replay does
+			d.contents[path] = want
+			d.paths[path] = true
+			continue
+		}
+		got, err := storedFile(store, previous, path)
+		if err != nil {
+			return err
+		}
+		for _, delta := range d.pending {
+			if delta.File == path {
+				got, _ = replayDelta(got, delta)
+			}
+		}
+
+		if got != want {
+			fix := Delta{
+				Time:     time.Now().UnixNano(),
+				Snapshot: id - 1,
+				File:     path,
+				Ops:      deltaOps(got, want),
+				Fix:      true,
+			}
+			if err := writeDelta(fix, projectPath); err != nil {
+				return err
+			}
+		}
+		if want == "" {
+			delete(d.contents, path)
+		} else {
+			d.contents[path] = want
+		}
+		d.paths[path] = true
+	}
+
+	d.pending = nil
+	d.snapshot = id
+	return nil
+}
+
+// snapshotDeltas returns the deltas that lead from snapshot id to id+1.
+func snapshotDeltas(deltas []Delta, id int) []Delta {
+	result := []Delta{}
+	for _, delta := range deltas {
+		if delta.Snapshot == id {
+			result = append(result, delta)
+		}
+	}
+	return result
+}
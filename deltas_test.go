@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// writeProjectFile writes a file of the test project with a modification
+// time of its own, so that the delta poller sees every write.
+func writeProjectFile(t *testing.T, dir string, path string, text string, stamp int) {
+	t.Helper()
+	name := filepath.Join(dir, path)
+	if err := ioutil.WriteFile(name, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Unix(1500000000+int64(stamp), 0)
+	if err := os.Chtimes(name, when, when); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newDeltaTestProject(t *testing.T) (string, SnapshotStore) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "live-deltas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, LIVE_DATA_DIR), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir, &GitStore{r: r, root: dir}
+}
+
+// replaySnapshot applies the logged deltas of snapshot id to its files and
+// checks that every text file of snapshot id+1 comes out identical.
+func replaySnapshot(t *testing.T, dir string, store SnapshotStore, id int) {
+	t.Helper()
+	deltas, err := loadDeltas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, from, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, to, err := store.Get(id + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	texts := map[string]string{}
+	for path := range from {
+		if texts[path], err = storedFile(store, from, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, delta := range snapshotDeltas(deltas, id) {
+		texts[delta.File], _ = replayDelta(texts[delta.File], delta)
+	}
+	for path := range to {
+		want, err := storedFile(store, to, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if texts[path] != want {
+			t.Errorf("snapshot %d: replayed %s is %q, want %q", id+1, path, texts[path], want)
+		}
+	}
+	for path, text := range texts {
+		if _, ok := to[path]; !ok && text != "" {
+			t.Errorf("snapshot %d: replayed %s is %q, want it removed", id+1, path, text)
+		}
+	}
+}
+
+func TestDeltasReproduceSnapshots(t *testing.T) {
+	dir, store := newDeltaTestProject(t)
+	writeProjectFile(t, dir, "main.go", "package main\n\nfunc main() {\n}\n", 0)
+	writeProjectFile(t, dir, "notes.txt", "todo\n", 0)
+	if _, err := store.Put(time.Now().UnixNano(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newDeltaRecorder(store, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeProjectFile(t, dir, "main.go", "package main\n\nfunc main() {\n\tprintln(1)\n}\n", 1)
+	d.record(dir)
+	writeProjectFile(t, dir, "main.go", "package main\n\nfunc main() {\n\tprintln(\"héllo\")\n}\n", 2)
+	d.record(dir)
+	// Changed twice between two polls, and a new file the poller does not
+	// know about yet: both are only seen at snapshot time.
+	writeProjectFile(t, dir, "notes.txt", "todo\ndone\n", 3)
+	writeProjectFile(t, dir, "notes.txt", "done\n", 4)
+	writeProjectFile(t, dir, "new.txt", "new\n", 4)
+	snapshot, err := store.Put(time.Now().UnixNano(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyDeltas(store, snapshot.ID, dir); err != nil {
+		t.Fatal(err)
+	}
+	replaySnapshot(t, dir, store, 0)
+
+	// The poller's idea of main.go went wrong, so its next delta does not
+	// apply to the snapshot. The fix has to start from what the replay
+	// makes of the deltas that do apply.
+	d.contents["main.go"] = "package main\n\nfunc main() {\n\tprintln(\"héllo\")\n\tprintln(\"a much longer line\")\n}\n"
+	writeProjectFile(t, dir, "main.go", "package main\n", 5)
+	d.record(dir)
+	writeProjectFile(t, dir, "main.go", "package main\n\nvar x = 1\n", 6)
+	d.record(dir)
+	os.Remove(filepath.Join(dir, "new.txt"))
+	d.watchPaths([]string{"new.txt"})
+	d.record(dir)
+	snapshot, err = store.Put(time.Now().UnixNano(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyDeltas(store, snapshot.ID, dir); err != nil {
+		t.Fatal(err)
+	}
+	replaySnapshot(t, dir, store, 1)
+}
+
+func TestDeltaRecorderIgnoresUnwatchedFiles(t *testing.T) {
+	dir, store := newDeltaTestProject(t)
+	writeProjectFile(t, dir, ".gitignore", "build/\n", 0)
+	writeProjectFile(t, dir, "main.go", "package main\n", 0)
+	if _, err := store.Put(time.Now().UnixNano(), ""); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDeltaRecorder(store, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "build"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeProjectFile(t, dir, "build/out.txt", "generated\n", 1)
+	d.record(dir)
+	if len(d.pending) != 0 {
+		t.Fatalf("recorded %v for an ignored file", d.pending)
+	}
+
+	writeProjectFile(t, dir, "main.go", "package main\n\nfunc main() {}\n", 1)
+	d.record(dir)
+	if len(d.pending) != 1 || d.pending[0].File != "main.go" {
+		t.Fatalf("recorded %v, want one delta of main.go", d.pending)
+	}
+}
+
+func TestDeltaRecorderSkipsFilesThatTurnBinary(t *testing.T) {
+	dir, store := newDeltaTestProject(t)
+	writeProjectFile(t, dir, "data.txt", "text\n", 0)
+	if _, err := store.Put(time.Now().UnixNano(), ""); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDeltaRecorder(store, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeProjectFile(t, dir, "data.txt", "\xff\xfe\x00\x01", 1)
+	d.record(dir)
+	if len(d.pending) != 0 {
+		t.Fatalf("a file that turned binary recorded %v", d.pending)
+	}
+	snapshot, err := store.Put(time.Now().UnixNano(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyDeltas(store, snapshot.ID, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// back to text, the deltas start from the binary snapshot
+	writeProjectFile(t, dir, "data.txt", "text again\n", 2)
+	d.record(dir)
+	snapshot, err = store.Put(time.Now().UnixNano(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyDeltas(store, snapshot.ID, dir); err != nil {
+		t.Fatal(err)
+	}
+	deltas, err := loadDeltas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, delta := range deltas {
+		if delta.Fix {
+			t.Errorf("verify had to fix %v", delta)
+		}
+	}
+	replaySnapshot(t, dir, store, 1)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// Event is one line of the session event log. Snapshot times live in the
+// snapshot index, everything else that happens during a live goes here.
+// LogOffset is the length of the terminal log when a marker was made.
+type Event struct {
+	Time      int64        `json:"time"`
+	Type      string       `json:"type"`
+	Snapshot  int          `json:"snapshot"`
+	Command   string       `json:"command,omitempty"`
+	Label     string       `json:"label,omitempty"`
+	ExitCode  int          `json:"exit_code"`
+	Duration  int64        `json:"duration,omitempty"`
+	Build     *BuildResult `json:"build,omitempty"`
+	Editor    *EditorEvent `json:"editor,omitempty"`
+	Author    string       `json:"author,omitempty"`
+	LogOffset int64        `json:"log_offset,omitempty"`
+}
+
+type Events []Event
+
+const EVENT_LOG = "events.jsonl"
+
+func writeEvent(event Event, projectPath string, liveStart bool) {
+	if liveStart == false {
+		return
+	}
+	// An event without a time happens now, in the latest snapshot. Callers
+	// that give the time give the snapshot too.
+	if event.Time == 0 {
+		event.Time = time.Now().UnixNano()
+		event.Snapshot = snapshotID()
+	}
+
+	eventLogPath := liveDataPath(projectPath, EVENT_LOG)
+	if err := os.MkdirAll(filepath.Dir(eventLogPath), 0755); err != nil {
+		log.Fatal(err)
+	}
+	file, err := os.OpenFile(eventLogPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(file, string(data))
+	file.Close()
+}
+
+func readEvents(projectPath string) (Events, error) {
+	events := Events{}
+	file, err := os.Open(liveDataPath(projectPath, EVENT_LOG))
+	if os.IsNotExist(err) {
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		event := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// exitCode returns the exit status of a finished command, or -1 if it could
+// not be started at all.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
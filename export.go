@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+)
+
+// live export <kind> [--session archive] [options]
+func liveExport(args []string, projectPath string) {
+	args, archivePath, _ := flagValue(args, "--session")
+	if len(args) == 0 {
+		writeCommandOut("usage: live export [tutorial, svg, patches, bundle] [--session archive]\n", projectPath, false)
+		return
+	}
+	if archivePath != "" {
+		dir, cleanup, err := unpackSessionTemp(archivePath)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		defer cleanup()
+		projectPath = dir
+	}
+	switch args[0] {
+	case "tutorial":
+		exportTutorial(args[1:], projectPath)
+	case "svg":
+		exportSVG(args[1:], projectPath)
+	case "patches":
+		exportPatches(args[1:], projectPath)
+	case "bundle":
+		exportBundle(args[1:], projectPath)
+	default:
+		writeCommandOut("usage: live export [tutorial, svg, patches, bundle] [--session archive]\n", projectPath, false)
+	}
+}
+
+// writeExport writes out to outputPath, or to the terminal if no -o was
+// given.
+func writeExport(out string, outputPath string, projectPath string) {
+	if outputPath == "" {
+		writeCommandOut(out, projectPath, false)
+		return
+	}
+	if err := ioutil.WriteFile(outputPath, []byte(out), 0644); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut("wrote "+outputPath+".\n", projectPath, false)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// GrepMatch is a line matching the pattern, with the first and the last
+// snapshot it existed in. Line is its line number in the last one.
+type GrepMatch struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Text      string `json:"text"`
+	First     int    `json:"first"`
+	Last      int    `json:"last"`
+	Snapshots int    `json:"snapshots"`
+}
+
+// GrepCache is the search state of one pattern, kept next to the snapshot
+// index so that only new snapshots are searched the next time. Only the
+// GREP_CACHE_SIZE patterns used last are kept.
+type GrepCache struct {
+	LastID   int                   `json:"last_id"`
+	LastHash string                `json:"last_hash"`
+	Used     int64                 `json:"used"`
+	Matches  map[string]*GrepMatch `json:"matches"`
+}
+
+const GREP_CACHE = "grep.json"
+const GREP_CACHE_SIZE = 20
+
+type blobLine struct {
+	line int
+	text string
+}
+
+func loadGrepCaches(projectPath string) map[string]*GrepCache {
+	caches := map[string]*GrepCache{}
+	data, err := ioutil.ReadFile(liveDataPath(projectPath, GREP_CACHE))
+	if err == nil {
+		if err := json.Unmarshal(data, &caches); err != nil {
+			caches = map[string]*GrepCache{}
+		}
+	}
+	return caches
+}
+
+func saveGrepCaches(projectPath string, caches map[string]*GrepCache) error {
+	for len(caches) > GREP_CACHE_SIZE {
+		oldest, used := "", int64(-1)
+		for pattern, cache := range caches {
+			if used < 0 || cache.Used < used {
+				oldest, used = pattern, cache.Used
+			}
+		}
+		delete(caches, oldest)
+	}
+	data, err := json.Marshal(caches)
+	if err != nil {
+		return err
+	}
+	path := liveDataPath(projectPath, GREP_CACHE)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// grepSnapshots searches every snapshot's tree, including the terminal log,
+// for lines matching pattern.
+func grepSnapshots(r *git.Repository, projectPath string, snapshots Snapshots, pattern string) ([]GrepMatch, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	caches := loadGrepCaches(projectPath)
+	cache, ok := caches[pattern]
+	if !ok || cache.LastID >= len(snapshots) || (cache.LastID >= 0 && snapshots[cache.LastID].Hash != cache.LastHash) {
+		cache = &GrepCache{LastID: -1, Matches: map[string]*GrepMatch{}}
+	}
+
+	blobs := map[string][]blobLine{}
+	for _, s := range snapshots[cache.LastID+1:] {
+		c, err := snapshotCommit(r, s)
+		if err != nil {
+			return nil, err
+		}
+		tree, err := c.Tree()
+		if err != nil {
+			return nil, err
+		}
+		iter := tree.Files()
+		for {
+			f, err := iter.Next()
+			if err != nil {
+				break
+			}
+			lines, ok := blobs[f.Hash.String()]
+			if !ok {
+				lines = []blobLine{}
+				if binary, err := f.IsBinary(); err == nil && !binary {
+					contents, err := f.Contents()
+					if err != nil {
+						return nil, err
+					}
+					for i, text := range strings.Split(contents, "\n") {
+						if re.MatchString(text) {
+							lines = append(lines, blobLine{line: i + 1, text: text})
+						}
+					}
+				}
+				blobs[f.Hash.String()] = lines
+			}
+
+			name := f.Name
+			if name == CUI_LOG {
+				name = "terminal"
+			}
+			for _, l := range lines {
+				key := name + "\x00" + l.text
+				m, ok := cache.Matches[key]
+				if !ok {
+					m = &GrepMatch{File: name, Text: l.text, First: s.ID}
+					cache.Matches[key] = m
+				}
+				if m.Last != s.ID || m.Snapshots == 0 {
+					m.Snapshots++
+				}
+				m.Last = s.ID
+				m.Line = l.line
+			}
+		}
+		cache.LastID = s.ID
+		cache.LastHash = s.Hash
+	}
+
+	cache.Used = time.Now().UnixNano()
+	caches[pattern] = cache
+	if err := saveGrepCaches(projectPath, caches); err != nil {
+		return nil, err
+	}
+
+	matches := []GrepMatch{}
+	for _, m := range cache.Matches {
+		matches = append(matches, *m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].First != matches[j].First {
+			return matches[i].First < matches[j].First
+		}
+		if matches[i].File != matches[j].File {
+			return matches[i].File < matches[j].File
+		}
+		return matches[i].Line < matches[j].Line
+	})
+	return matches, nil
+}
+
+// live grep [-i] [--json] <pattern>
+// The pattern is the rest of the line after the flags, as typed, so runs
+// of spaces in it are kept.
+func liveGrep(args []string, line string, projectPath string) {
+	jsonOutput := false
+	ignoreCase := false
+	flags := 0
+	for ; flags < len(args); flags++ {
+		if args[flags] == "--json" {
+			jsonOutput = true
+		} else if args[flags] == "-i" {
+			ignoreCase = true
+		} else {
+			break
+		}
+	}
+	pattern := restOfLine(line, 2+flags)
+	if pattern == "" {
+		writeCommandOut("usage: live grep [-i] [--json] <pattern>\n", projectPath, false)
+		return
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	matches, err := grepSnapshots(r, root, snapshots, pattern)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	if jsonOutput {
+		data, err := json.Marshal(matches)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		writeCommandOut(string(data)+"\n", projectPath, false)
+		return
+	}
+
+	out := ""
+	latest := len(snapshots) - 1
+	for _, m := range matches {
+		last := fmt.Sprintf("%d", m.Last)
+		if m.Last == latest {
+			last = "now"
+		}
+		out += fmt.Sprintf("\x1b[35m%s:%d\x1b[0m \x1b[32m%d-%s\x1b[0m %s\n", m.File, m.Line, m.First, last, strings.TrimSpace(m.Text))
+	}
+	writeCommandOut(out, projectPath, false)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Hook is a shell command run around each snapshot commit in watch().
+type Hook struct {
+	Command string `json:"command"`
+	Timeout int    `json:"timeout,omitempty"`
+}
+
+type Hooks struct {
+	PreSnapshot  []Hook `json:"pre_snapshot"`
+	PostSnapshot []Hook `json:"post_snapshot"`
+}
+
+// SnapshotHookInput is written as JSON to the stdin of post-snapshot hooks.
+type SnapshotHookInput struct {
+	ID    int      `json:"id"`
+	Hash  string   `json:"hash"`
+	Time  int64    `json:"time"`
+	Files []string `json:"files"`
+}
+
+const DEFAULT_HOOK_TIMEOUT = 10
+
+// A pre-snapshot hook exiting with HOOK_DELAY_EXIT_CODE (EX_TEMPFAIL) puts
+// the snapshot off until the next tick without reporting anything. Any other
+// non-zero exit vetoes the snapshot and is reported in the shell.
+const HOOK_DELAY_EXIT_CODE = 75
+
+const (
+	HOOK_PROCEED = iota
+	HOOK_DELAY
+	HOOK_VETO
+)
+
+// lastHookFailure keeps a failing pre-snapshot hook from being reported
+// again every second.
+var lastHookFailure string
+
+func runHook(hook Hook, projectPath string, stdin []byte) (string, error) {
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_HOOK_TIMEOUT
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("bash", "-c", hook.Command)
+	cmd.Dir = projectPath
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	timedOut, err := runWithTimeout(cmd, time.Duration(timeout)*time.Second, nil)
+	if timedOut {
+		return out.String(), errors.New("timed out after " + strconv.Itoa(timeout) + "s")
+	}
+	return out.String(), err
+}
+
+// runWithTimeout runs cmd in a process group of its own and kills the
+// whole group once timeout has passed, or stop is closed. Killing only
+// bash would leave the rest of a pipeline holding the output open, and
+// Wait with it.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration, stop <-chan struct{}) (bool, error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, err
+	case <-timer.C:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return true, <-done
+	case <-stop:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return false, errors.New("interrupted")
+	}
+}
+
+func reportHookFailure(kind string, hook Hook, out string, err error, projectPath string) {
+	message := "\n" + kind + " hook \"" + hook.Command + "\" failed: " + err.Error() + "\n"
+	if out != "" {
+		message += out
+		if out[len(out)-1] != '\n' {
+			message += "\n"
+		}
+	}
+	writeCommandOut(message, projectPath, false)
+}
+
+// runPreSnapshotHooks runs the hooks in order and stops at the first one
+// that does not let the snapshot through.
+func runPreSnapshotHooks(hooks []Hook, projectPath string) int {
+	for _, hook := range hooks {
+		out, err := runHook(hook, projectPath, nil)
+		if err == nil {
+			continue
+		}
+		if exitCode(err) == HOOK_DELAY_EXIT_CODE {
+			return HOOK_DELAY
+		}
+		failure := hook.Command + "\x00" + out
+		if failure != lastHookFailure {
+			reportHookFailure("pre-snapshot", hook, out, err, projectPath)
+			lastHookFailure = failure
+		}
+		return HOOK_VETO
+	}
+	lastHookFailure = ""
+	return HOOK_PROCEED
+}
+
+func runPostSnapshotHooks(hooks []Hook, projectPath string, input SnapshotHookInput) {
+	if len(hooks) == 0 {
+		return
+	}
+	data, err := json.Marshal(input)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	for _, hook := range hooks {
+		out, err := runHook(hook, projectPath, data)
+		if err != nil {
+			reportHookFailure("post-snapshot", hook, out, err, projectPath)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// IdleConfig is the "idle" section of .live.json. A live is paused after
+// PauseAfter minutes without file changes or commands, and resumed by the
+// next one. 0 never pauses.
+type IdleConfig struct {
+	PauseAfter float64 `json:"pause_after"`
+}
+
+const ARM_POLL_INTERVAL = time.Second
+
+var idleMutex sync.Mutex
+var lastActivity time.Time
+
+// livePaused is set while a running live is paused for being idle.
+var livePaused bool
+
+// armed is made by "live arm" and closed when the first change starts the
+// live or "live stop" disarms it, which stops the goroutine waiting for
+// the change. It is nil when nothing is armed.
+var armed chan struct{}
+
+func isArmed() bool {
+	idleMutex.Lock()
+	defer idleMutex.Unlock()
+	return armed != nil
+}
+
+func disarm() {
+	idleMutex.Lock()
+	if armed != nil {
+		close(armed)
+		armed = nil
+	}
+	idleMutex.Unlock()
+}
+
+// startLive starts capturing the project, unless a live is already
+// started. watch() runs until liveStart is cleared.
+func startLive(r *git.Repository, projectPath string, couterHTMLPath string) bool {
+	liveStartMutex.Lock()
+	if liveStart {
+		liveStartMutex.Unlock()
+		return false
+	}
+	liveStart = true
+	liveStartMutex.Unlock()
+	disarm()
+
+	idleMutex.Lock()
+	lastActivity = time.Now()
+	livePaused = false
+	idleMutex.Unlock()
+	statusMutex.Lock()
+	liveStartedAt = time.Now()
+	pendingFiles = 0
+	statusMutex.Unlock()
+
+	writeEvent(Event{Type: "start"}, projectPath, isLiveStarted())
+	stopControlSocket()
+	if err := startControlSocket(projectPath); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+	}
+
+	go watch(r, projectPath, couterHTMLPath)
+	return true
+}
+
+// touchActivity records a file change or a command, and resumes the live
+// if it was paused. The resume event has the length of the idle gap.
+func touchActivity(projectPath string, couterHTMLPath string) {
+	idleMutex.Lock()
+	paused := livePaused
+	pausedFor := time.Since(lastActivity)
+	lastActivity = time.Now()
+	livePaused = false
+	idleMutex.Unlock()
+
+	if !paused || isLiveStarted() == false {
+		return
+	}
+	writeEvent(Event{Type: "resume", Duration: pausedFor.Nanoseconds()}, projectPath, isLiveStarted())
+	createCounterHTML(counterMessage(snapshotID()), couterHTMLPath)
+}
+
+// checkIdle pauses the live once nothing has happened for the configured
+// time. A command still running counts as activity.
+func checkIdle(config ProjectConfig, projectPath string, couterHTMLPath string) {
+	if config.Idle.PauseAfter <= 0 {
+		return
+	}
+	foregroundMutex.Lock()
+	running := foreground != nil
+	foregroundMutex.Unlock()
+
+	idleMutex.Lock()
+	if running {
+		lastActivity = time.Now()
+	}
+	limit := time.Duration(config.Idle.PauseAfter * float64(time.Minute))
+	pause := !livePaused && time.Since(lastActivity) >= limit
+	if pause {
+		livePaused = true
+	}
+	idleMutex.Unlock()
+
+	if !pause {
+		return
+	}
+	writeEvent(Event{Type: "pause", Label: "idle for " + limit.String()}, projectPath, isLiveStarted())
+	createCounterHTML(counterMessage(snapshotID()), couterHTMLPath)
+}
+
+func isPaused() bool {
+	idleMutex.Lock()
+	defer idleMutex.Unlock()
+	return livePaused
+}
+
+// fileStamps has the size and modification time of every file of dir
+// except .git and the terminal log.
+func fileStamps(dir string) map[string]string {
+	stamps := map[string]string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == CUI_LOG {
+			return nil
+		}
+		stamps[path] = fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return stamps
+}
+
+func stampsChanged(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for path, stamp := range a {
+		if b[path] != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForChange starts the live on the first change in the project, unless
+// cancel is closed first, by "live stop" or a live started by hand.
+func waitForChange(r *git.Repository, projectPath string, couterHTMLPath string, cancel chan struct{}) {
+	stamps := fileStamps(projectPath)
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-time.After(ARM_POLL_INTERVAL):
+		}
+		if stampsChanged(stamps, fileStamps(projectPath)) {
+			break
+		}
+	}
+
+	idleMutex.Lock()
+	current := armed == cancel
+	idleMutex.Unlock()
+	if !current || !startLive(r, projectPath, couterHTMLPath) {
+		return
+	}
+	createCounterHTML(counterMessage(snapshotID()), couterHTMLPath)
+	writeCommandOut("\nlive is started on a change in "+projectPath+".\n", projectPath, false)
+}
+
+// live arm <path>
+func liveArm(path string, projectPath string, couterHTMLPath string) string {
+	if isLiveStarted() {
+		writeCommandOut("live is already started.\n", projectPath, false)
+		return projectPath
+	}
+	if isArmed() {
+		writeCommandOut("live is already armed.\n", projectPath, false)
+		return projectPath
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return projectPath
+	}
+	r, err := git.PlainOpen(absPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return projectPath
+	}
+	if err := os.Chdir(absPath); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return projectPath
+	}
+
+	cancel := make(chan struct{})
+	idleMutex.Lock()
+	armed = cancel
+	idleMutex.Unlock()
+	createCounterHTML("armed", couterHTMLPath)
+	if err := startControlSocket(absPath); err != nil {
+		writeCommandOut(err.Error()+"\n", absPath, false)
+	}
+	go waitForChange(r, absPath, couterHTMLPath, cancel)
+	writeCommandOut("live is armed, it starts on the first change in "+absPath+".\n", absPath, false)
+	return absPath
+}
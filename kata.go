@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KataTemplate is an exercise "live init --template" starts from. Files are
+// the starter files. HiddenFiles, such as the tests of a hidden kata, never
+// enter the work tree and are only added to the copy the test runs in.
+type KataTemplate struct {
+	Description string            `json:"description"`
+	Test        string            `json:"test"`
+	Hidden      bool              `json:"hidden"`
+	TimeLimit   int               `json:"time_limit"`
+	Files       map[string]string `json:"-"`
+	HiddenFiles map[string]string `json:"-"`
+}
+
+// Kata is kept in .git/live/kata.json. FirstGreen is the first snapshot the
+// test passed on, and FirstGreenSeconds the time it took from the start.
+type Kata struct {
+	Template          string  `json:"template"`
+	Test              string  `json:"test"`
+	Hidden            bool    `json:"hidden"`
+	TimeLimit         int     `json:"time_limit"`
+	Started           int64   `json:"started"`
+	FirstGreen        int     `json:"first_green"`
+	FirstGreenSeconds float64 `json:"first_green_seconds,omitempty"`
+	TimeUp            bool    `json:"time_up,omitempty"`
+}
+
+const KATA_STATE = "kata.json"
+const KATA_HIDDEN_DIR = "kata"
+const KATA_TEMPLATES = ".live/templates"
+const KATA_TEMPLATE_CONFIG = "template.json"
+const KATA_TEST_NAME = "kata test"
+const KATA_TEST_TIMEOUT = 60 * time.Second
+
+const kataGoMod = "module kata\n\ngo 1.13\n"
+
+var kataTemplates = map[string]KataTemplate{
+	"fizzbuzz-go": {
+		Description: "FizzBuzz in Go, with the tests in the project",
+		Test:        "go test ./...",
+		TimeLimit:   15 * 60,
+		Files: map[string]string{
+			"go.mod":      kataGoMod,
+			"fizzbuzz.go": "package kata\n\n// FizzBuzz returns \"Fizz\" for multiples of 3, \"Buzz\" for multiples of 5,\n// \"FizzBuzz\" for multiples of both and the number otherwise.\nfunc FizzBuzz(n int) string {\n\treturn \"\"\n}\n",
+			"fizzbuzz_test.go": `package kata
+
+import "testing"
+
+func TestFizzBuzz(t *testing.T) {
+	cases := map[int]string{1: "1", 2: "2", 3: "Fizz", 5: "Buzz", 6: "Fizz", 10: "Buzz", 15: "FizzBuzz", 30: "FizzBuzz", 31: "31"}
+	for n, want := range cases {
+		if got := FizzBuzz(n); got != want {
+			t.Errorf("FizzBuzz(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+`,
+		},
+	},
+	"roman-go": {
+		Description: "Roman numerals in Go, with hidden tests",
+		Test:        "go test ./...",
+		Hidden:      true,
+		TimeLimit:   20 * 60,
+		Files: map[string]string{
+			"go.mod":   kataGoMod,
+			"roman.go": "package kata\n\n// Roman returns n, from 1 to 3999, in roman numerals.\nfunc Roman(n int) string {\n\treturn \"\"\n}\n",
+		},
+		HiddenFiles: map[string]string{
+			"roman_test.go": `package kata
+
+import "testing"
+
+func TestRoman(t *testing.T) {
+	cases := map[int]string{1: "I", 4: "IV", 9: "IX", 14: "XIV", 40: "XL", 90: "XC", 400: "CD", 1994: "MCMXCIV", 2024: "MMXXIV", 3999: "MMMCMXCIX"}
+	for n, want := range cases {
+		if got := Roman(n); got != want {
+			t.Errorf("Roman(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+`,
+		},
+	},
+}
+
+// kata is the kata of the project being recorded, nil outside of kata mode.
+// watch() sets it and the prompt reads it, so it is only used under
+// kataMutex.
+var kata *KataRunner
+var kataMutex sync.Mutex
+
+func currentKata() *KataRunner {
+	kataMutex.Lock()
+	defer kataMutex.Unlock()
+	return kata
+}
+
+// KataRunner runs the test of the kata on the latest snapshot. A snapshot
+// taken while the test is running replaces the one waiting; the ones
+// skipped are tested once a later one passes, so that the first green is
+// the first snapshot that passes. Tested is the latest snapshot tested.
+type KataRunner struct {
+	mutex          sync.Mutex
+	kata           Kata
+	store          SnapshotStore
+	projectPath    string
+	couterHTMLPath string
+	pending        chan int
+	stopped        bool
+	done           chan struct{}
+	tested         int
+	timer          *time.Timer
+}
+
+// readDir reads every file under dir, by slash separated path.
+func readDir(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	return files, err
+}
+
+func writeFiles(dir string, files map[string]string) error {
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadKataTemplate finds name in ~/.live/templates first, then among the
+// built-in templates. A template directory holds template.json, the
+// starter files in files/ and the hidden files in hidden/.
+func loadKataTemplate(name string) (KataTemplate, error) {
+	template := KataTemplate{}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return template, err
+	}
+	dir := filepath.Join(home, filepath.FromSlash(KATA_TEMPLATES), name)
+	data, err := ioutil.ReadFile(filepath.Join(dir, KATA_TEMPLATE_CONFIG))
+	if os.IsNotExist(err) {
+		if template, ok := kataTemplates[name]; ok {
+			return template, nil
+		}
+		return template, errors.New("template " + name + " doesn't exist, the templates are: " + strings.Join(kataTemplateNames(), ", "))
+	}
+	if err != nil {
+		return template, err
+	}
+	if err := json.Unmarshal(data, &template); err != nil {
+		return template, errors.New(KATA_TEMPLATE_CONFIG + ": " + err.Error())
+	}
+	if template.Test == "" {
+		return template, errors.New(KATA_TEMPLATE_CONFIG + ": test is missing")
+	}
+	template.Files, template.HiddenFiles = map[string]string{}, map[string]string{}
+	for sub, files := range map[string]*map[string]string{"files": &template.Files, "hidden": &template.HiddenFiles} {
+		if _, err := os.Stat(filepath.Join(dir, sub)); os.IsNotExist(err) {
+			continue
+		}
+		if *files, err = readDir(filepath.Join(dir, sub)); err != nil {
+			return template, err
+		}
+	}
+	return template, nil
+}
+
+func kataTemplateNames() []string {
+	names := []string{}
+	for name := range kataTemplates {
+		names = append(names, name)
+	}
+	home, err := os.UserHomeDir()
+	if err == nil {
+		dirs, _ := ioutil.ReadDir(filepath.Join(home, filepath.FromSlash(KATA_TEMPLATES)))
+		for _, dir := range dirs {
+			if _, ok := kataTemplates[dir.Name()]; dir.IsDir() && !ok {
+				names = append(names, dir.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scaffoldKata writes the starter files to the new project and starts the
+// clock. A visible test is also made a build of the project, so that
+// running it by hand shows on the timeline too.
+func scaffoldKata(projectPath string, name string, template KataTemplate) error {
+	if err := writeFiles(projectPath, template.Files); err != nil {
+		return err
+	}
+	if err := writeFiles(liveDataPath(projectPath, KATA_HIDDEN_DIR), template.HiddenFiles); err != nil {
+		return err
+	}
+	if !template.Hidden {
+		if _, err := os.Stat(filepath.Join(projectPath, PROJECT_CONFIG)); os.IsNotExist(err) {
+			config := map[string][]BuildPattern{"builds": append([]BuildPattern{{Name: KATA_TEST_NAME, Pattern: "^" + regexp.QuoteMeta(template.Test) + "$"}}, defaultBuildPatterns...)}
+			data, err := json.MarshalIndent(config, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(projectPath, PROJECT_CONFIG), append(data, '\n'), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return saveKata(projectPath, Kata{
+		Template:   name,
+		Test:       template.Test,
+		Hidden:     template.Hidden,
+		TimeLimit:  template.TimeLimit,
+		Started:    time.Now().UnixNano(),
+		FirstGreen: -1,
+	})
+}
+
+func loadKata(projectPath string) (*Kata, error) {
+	data, err := ioutil.ReadFile(liveDataPath(projectPath, KATA_STATE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	k := &Kata{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func saveKata(projectPath string, k Kata) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(liveDataPath(projectPath, ""), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(liveDataPath(projectPath, KATA_STATE), data, 0644)
+}
+
+func (k Kata) deadline() time.Time {
+	return time.Unix(0, k.Started).Add(time.Duration(k.TimeLimit) * time.Second)
+}
+
+// startKata is called by watch(). It does nothing outside of kata mode.
+func startKata(store SnapshotStore, projectPath string, couterHTMLPath string) {
+	stopKata()
+	k, err := loadKata(projectPath)
+	if err != nil {
+		writeCommandOut(KATA_STATE+": "+err.Error()+"\n", projectPath, false)
+		return
+	}
+	if k == nil {
+		return
+	}
+	runner := &KataRunner{kata: *k, store: store, projectPath: projectPath, couterHTMLPath: couterHTMLPath, pending: make(chan int, 1), done: make(chan struct{}), tested: snapshotID()}
+	if k.TimeLimit > 0 && k.FirstGreen < 0 && !k.TimeUp {
+		runner.timer = time.AfterFunc(time.Until(k.deadline()), runner.timeUp)
+	}
+	kataMutex.Lock()
+	kata = runner
+	kataMutex.Unlock()
+	go runner.run()
+}
+
+func stopKata() {
+	kataMutex.Lock()
+	k := kata
+	kata = nil
+	kataMutex.Unlock()
+	if k != nil {
+		k.mutex.Lock()
+		k.stopped = true
+		if k.timer != nil {
+			k.timer.Stop()
+		}
+		close(k.pending)
+		k.mutex.Unlock()
+		// the next runner must not test while this one still is
+		<-k.done
+	}
+}
+
+// snapshot queues the test of snapshot id, unless the runner was stopped.
+func (k *KataRunner) snapshot(id int) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.stopped {
+		return
+	}
+	select {
+	case <-k.pending:
+	default:
+	}
+	k.pending <- id
+}
+
+func (k *KataRunner) run() {
+	defer close(k.done)
+	for id := range k.pending {
+		k.testSnapshot(id)
+		createCounterHTML(counterMessage(snapshotID()), k.couterHTMLPath)
+	}
+}
+
+// testSnapshot tests snapshot id and, the first time a snapshot passes,
+// the snapshots skipped since the last one tested, in order.
+func (k *KataRunner) testSnapshot(id int) {
+	result := k.test(id)
+	setLastBuild(result)
+	k.writeTestEvent(id, result)
+
+	k.mutex.Lock()
+	green := result.Passed && k.kata.FirstGreen < 0
+	k.mutex.Unlock()
+	first := id
+	if green {
+		for skipped := k.tested + 1; skipped < id; skipped++ {
+			r := k.test(skipped)
+			k.writeTestEvent(skipped, r)
+			if r.Passed {
+				first = skipped
+				break
+			}
+		}
+	}
+	k.tested = id
+	if green {
+		k.green(first)
+	}
+}
+
+func (k *KataRunner) writeTestEvent(id int, result *BuildResult) {
+	writeEvent(Event{Time: time.Now().UnixNano(), Snapshot: id, Type: "test", Label: "snapshot " + strconv.Itoa(id), Build: result}, k.projectPath, isLiveStarted())
+}
+
+// green records snapshot id as the first passing one. The time to green
+// is the time the snapshot was taken.
+func (k *KataRunner) green(id int) {
+	snapshot, _, err := k.store.Get(id)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", k.projectPath, false)
+		return
+	}
+	k.mutex.Lock()
+	k.kata.FirstGreen = id
+	k.kata.FirstGreenSeconds = float64(snapshot.Time-k.kata.Started) / float64(time.Second)
+	seconds := k.kata.FirstGreenSeconds
+	if k.timer != nil {
+		k.timer.Stop()
+	}
+	if err := saveKata(k.projectPath, k.kata); err != nil {
+		writeCommandOut(err.Error()+"\n", k.projectPath, false)
+	}
+	k.mutex.Unlock()
+
+	writeEvent(Event{Time: time.Now().UnixNano(), Snapshot: id, Type: "kata", Label: "green"}, k.projectPath, isLiveStarted())
+	writeCommandOut("\n[kata] green at ID "+strconv.Itoa(id)+" after "+formatSeconds(seconds)+".\n", k.projectPath, isLiveStarted())
+}
+
+// test runs the test in a checkout of snapshot id with the hidden files
+// added, so that nothing it writes ends up in a snapshot.
+func (k *KataRunner) test(id int) *BuildResult {
+	result := &BuildResult{Name: KATA_TEST_NAME}
+	dir, err := ioutil.TempDir("", "live-kata")
+	if err != nil {
+		result.Summary = err.Error()
+		return result
+	}
+	defer os.RemoveAll(dir)
+	if err := k.checkout(id, dir); err != nil {
+		result.Summary = err.Error()
+		return result
+	}
+	hidden, err := readDir(liveDataPath(k.projectPath, KATA_HIDDEN_DIR))
+	if err != nil && !os.IsNotExist(err) {
+		result.Summary = err.Error()
+		return result
+	}
+	if err := writeFiles(dir, hidden); err != nil {
+		result.Summary = err.Error()
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), KATA_TEST_TIMEOUT)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "bash", "-c", k.kata.Test)
+	cmd.Dir = dir
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	result.Passed = err == nil
+	result.Summary = lastLine(out.String())
+	if ctx.Err() == context.DeadlineExceeded {
+		result.Summary = "timed out after " + KATA_TEST_TIMEOUT.String()
+	}
+	return result
+}
+
+// checkout writes every file of snapshot id to dir.
+func (k *KataRunner) checkout(id int, dir string) error {
+	_, files, err := k.store.Get(id)
+	if err != nil {
+		return err
+	}
+	for name, f := range files {
+		data, err := k.store.Blob(f.Hash)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, data, f.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *KataRunner) timeUp() {
+	k.mutex.Lock()
+	if k.kata.FirstGreen >= 0 || isLiveStarted() == false {
+		k.mutex.Unlock()
+		return
+	}
+	k.kata.TimeUp = true
+	if err := saveKata(k.projectPath, k.kata); err != nil {
+		writeCommandOut(err.Error()+"\n", k.projectPath, false)
+	}
+	k.mutex.Unlock()
+
+	writeEvent(Event{Type: "kata", Label: "time up"}, k.projectPath, isLiveStarted())
+	writeCommandOut("\n[kata] time is up.\n", k.projectPath, isLiveStarted())
+	createCounterHTML(counterMessage(snapshotID()), k.couterHTMLPath)
+}
+
+// countdown is added to the counter page. The page counts down by itself
+// from the deadline, and shows the time to green once the test passes.
+func (k *KataRunner) countdown() string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.kata.FirstGreen >= 0 {
+		return fmt.Sprintf(`<span style="display:block;font-size:0.4em;color:#2a2">green in %s</span>`, formatSeconds(k.kata.FirstGreenSeconds))
+	}
+	if k.kata.TimeLimit <= 0 {
+		return ""
+	}
+	deadline := k.kata.deadline().UnixNano() / int64(time.Millisecond)
+	return `<span id="kata" style="display:block;font-size:0.4em"></span><script>(function(){var e=document.getElementById("kata");function tick(){var s=Math.round((` + strconv.FormatInt(deadline, 10) + `-Date.now())/1000);if(s<=0){e.style.color="#d22";e.textContent="time is up";return}e.textContent=Math.floor(s/60)+":"+("0"+s%60).slice(-2)}tick();setInterval(tick,1000)})()</script>`
+}
+
+// kataSummary is the kata line of "live stats".
+func kataSummary(k *Kata) string {
+	summary := k.Template + ", "
+	if k.FirstGreen >= 0 {
+		summary += "green at ID " + strconv.Itoa(k.FirstGreen) + " after " + formatSeconds(k.FirstGreenSeconds)
+	} else if k.TimeUp {
+		summary += "time is up"
+	} else {
+		summary += "not green yet"
+	}
+	if k.TimeLimit > 0 {
+		summary += " (limit " + formatSeconds(float64(k.TimeLimit)) + ")"
+	}
+	return summary
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKataFindsFirstPassingSnapshot(t *testing.T) {
+	dir, store := newDeltaTestProject(t)
+	started := time.Now().UnixNano()
+	// the test needs a binary fixture, which has to be in the checkout too
+	fixture := "\xff\xfe\x00\x01"
+	writeProjectFile(t, dir, "fixture.bin", fixture, 0)
+	writeProjectFile(t, dir, "answer.txt", "todo\n", 0)
+	times := []int64{started + int64(time.Second), started + 5*int64(time.Second), started + 9*int64(time.Second)}
+	for i, answer := range []string{"todo\n", "done\n", "done, and tidied\n"} {
+		writeProjectFile(t, dir, "answer.txt", answer, i+1)
+		if _, err := store.Put(times[i], ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the work tree has moved on and fails again
+	writeProjectFile(t, dir, "answer.txt", "todo again\n", 10)
+	if err := os.MkdirAll(liveDataPath(dir, KATA_HIDDEN_DIR), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(liveDataPath(dir, KATA_HIDDEN_DIR), "check.sh"), []byte("grep -q done answer.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &KataRunner{
+		kata:        Kata{Test: "printf '\\377\\376\\000\\001' | cmp -s - fixture.bin && bash check.sh", Started: started, FirstGreen: -1},
+		store:       store,
+		projectPath: dir,
+		tested:      0,
+	}
+	// snapshot 1 was skipped while snapshot 0 was tested
+	k.testSnapshot(2)
+	if k.kata.FirstGreen != 1 {
+		t.Fatalf("first green is ID %d, want 1", k.kata.FirstGreen)
+	}
+	if k.kata.FirstGreenSeconds != 5 {
+		t.Errorf("green after %gs, want 5s from the start to snapshot 1", k.kata.FirstGreenSeconds)
+	}
+	if b := latestBuild(); b == nil || !b.Passed {
+		t.Errorf("the last build is %v, want snapshot 2 passing", b)
+	}
+	saved, err := loadKata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil || saved.FirstGreen != 1 {
+		t.Errorf("saved %v, want first green at ID 1", saved)
+	}
+
+	if result := k.test(0); result.Passed {
+		t.Errorf("snapshot 0 passed")
+	}
+}
+
+func TestKataSnapshotAfterStop(t *testing.T) {
+	dir, store := newDeltaTestProject(t)
+	k := &KataRunner{kata: Kata{FirstGreen: -1}, store: store, projectPath: dir, pending: make(chan int, 1), done: make(chan struct{})}
+	kataMutex.Lock()
+	kata = k
+	kataMutex.Unlock()
+	go k.run()
+
+	stopKata()
+	select {
+	case <-k.done:
+	default:
+		t.Fatal("stopKata returned before the runner")
+	}
+	// a snapshot taken while the watch stops is dropped
+	k.snapshot(1)
+}
@@ -2,25 +2,18 @@ package main
 
 import (
 	"archive/tar"
-	"bufio"
-	"bytes"
 	"compress/gzip"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	git "gopkg.in/src-d/go-git.v4"
-	"gopkg.in/src-d/go-git.v4/plumbing"
-	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 type ErrorResponse struct {
@@ -47,7 +40,72 @@ type UploadsResponse []UploadResponse
 
 // type Commits []Commit
 
+// liveStart is set while a live is running. The prompt, watch(), the
+// signal handler and the control socket all look at it, so it is only used
+// under liveStartMutex.
 var liveStart bool
+var liveStartMutex sync.Mutex
+
+func isLiveStarted() bool {
+	liveStartMutex.Lock()
+	defer liveStartMutex.Unlock()
+	return liveStart
+}
+
+func setLiveStarted(started bool) {
+	liveStartMutex.Lock()
+	liveStart = started
+	liveStartMutex.Unlock()
+}
+
+// currentSnapshotID is the ID of the latest snapshot, -1 before the first.
+// It is shared by the prompt, watch() and the control socket, so it is
+// only used under snapshotIDMutex.
+var currentSnapshotID = -1
+var snapshotIDMutex sync.Mutex
+
+// snapshotMarks are the IDs and times of the snapshots taken since the live
+// was started, so that an event can be attached to the snapshot in effect
+// when it began.
+var snapshotMarks = []SnapshotMark{}
+
+type SnapshotMark struct {
+	ID   int
+	Time int64
+}
+
+func snapshotID() int {
+	snapshotIDMutex.Lock()
+	defer snapshotIDMutex.Unlock()
+	return currentSnapshotID
+}
+
+// resetSnapshotID starts the marks of a new live at snapshot id.
+func resetSnapshotID(id int) {
+	snapshotIDMutex.Lock()
+	currentSnapshotID = id
+	snapshotMarks = []SnapshotMark{{ID: id}}
+	snapshotIDMutex.Unlock()
+}
+
+func setSnapshotID(id int, t int64) {
+	snapshotIDMutex.Lock()
+	currentSnapshotID = id
+	snapshotMarks = append(snapshotMarks, SnapshotMark{ID: id, Time: t})
+	snapshotIDMutex.Unlock()
+}
+
+// snapshotAt returns the snapshot that was the latest at time t.
+func snapshotAt(t int64) int {
+	snapshotIDMutex.Lock()
+	defer snapshotIDMutex.Unlock()
+	for i := len(snapshotMarks) - 1; i >= 0; i-- {
+		if snapshotMarks[i].Time <= t {
+			return snapshotMarks[i].ID
+		}
+	}
+	return currentSnapshotID
+}
 
 const CUI_LOG = ".cui.log"
 
@@ -62,7 +120,15 @@ func compress(src string, buf io.Writer) error {
 	tw := tar.NewWriter(zr)
 
 	// walk through every file in the folder
-	filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+	err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// sockets, such as the control socket, pipes and links are left out
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+
 		// generate tar header
 		header, err := tar.FileInfoHeader(fi, file)
 		if err != nil {
@@ -83,12 +149,16 @@ func compress(src string, buf io.Writer) error {
 			if err != nil {
 				return err
 			}
+			defer data.Close()
 			if _, err := io.Copy(tw, data); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
 	// produce tar
 	if err := tw.Close(); err != nil {
@@ -140,88 +210,113 @@ func writeCommandOut(out string, projectPath string, liveStart bool) {
 }
 
 func liveCommandUsage(projectPath string) {
-	out := "usage: live [start, stop]\n"
+	out := "usage: live [init, start, stop, status, upload, login, unpublish, visibility, blame, stats, mark, note, replay, serve, grep, bisect, restore, compare, store, pack, unpack, perform, merge, arm, export]\n"
 	writeCommandOut(out, projectPath, false)
 }
 
 func watch(r *git.Repository, projectPath string, couterHTMLPath string) error {
-	w, err := r.Worktree()
+	store, err := openSnapshotStore(r, projectPath)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
 
+	resetSnapshotID(-1)
+	if n, err := store.Len(); err == nil {
+		resetSnapshotID(n - 1)
+	}
+	configError := ""
+
+	setDeltaRecorder(nil)
+	if config, err := loadProjectConfig(projectPath); err == nil && config.Deltas {
+		d, err := newDeltaRecorder(store, projectPath, snapshotID())
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		setDeltaRecorder(d)
+		go d.watch(projectPath)
+	}
+	startKata(store, projectPath, couterHTMLPath)
+	defer stopKata()
+
+	config, _ := loadProjectConfig(projectPath)
 	for {
-		if liveStart == false {
+		if isLiveStarted() == false {
 			return nil
 		}
 
 		time.Sleep(time.Second * 1)
+		checkIdle(config, projectPath, couterHTMLPath)
 
-		status, err := w.Status()
+		changedFiles, err := store.Changes()
 		if err != nil {
 			fmt.Println(err)
 			return err
 		}
-		// fmt.Println(status.String())
-
-		if len(status) != 0 {
-			// err = w.AddGlob(".")
-			// if err != nil {
-			// 	fmt.Println(err)
-			// 	return err
-			// }
+		setPendingFiles(len(changedFiles))
+		if d := currentDeltaRecorder(); d != nil {
+			d.watchPaths(changedFiles)
+		}
 
-			cmd := exec.Command("git", "add", ".")
-			err := cmd.Run()
-			if err != nil {
-				fmt.Println(err)
-				return err
+		if len(changedFiles) != 0 {
+			touchActivity(projectPath, couterHTMLPath)
+			config, err = loadProjectConfig(projectPath)
+			if err != nil && err.Error() != configError {
+				writeCommandOut(PROJECT_CONFIG+": "+err.Error()+"\n", projectPath, false)
 			}
-
-			commit, err := w.Commit(strconv.FormatInt(time.Now().UnixNano(), 10), &git.CommitOptions{
-				Author: &object.Signature{
-					When: time.Now(),
-				},
-			})
+			configError = ""
 			if err != nil {
-				fmt.Println(err)
-				return err
+				configError = err.Error()
+			}
+			if runPreSnapshotHooks(config.Hooks.PreSnapshot, projectPath) != HOOK_PROCEED {
+				continue
 			}
 
-			w.Checkout(&git.CheckoutOptions{
-				Branch: plumbing.NewBranchReferenceName("master"),
-			})
+			snapshotMutex.Lock()
+			if changed, err := store.Changes(); err == nil && len(changed) == 0 {
+				snapshotMutex.Unlock()
+				continue
+			}
 
-			_, err = r.CommitObject(commit)
+			snapshot, err := store.Put(time.Now().UnixNano(), "")
 			if err != nil {
+				snapshotMutex.Unlock()
 				fmt.Println(err)
 				return err
 			}
+			setSnapshotID(snapshot.ID, snapshot.Time)
+			setPendingFiles(0)
 
-			cIter, err := r.Log(&git.LogOptions{Order: git.LogOrderCommitterTime})
-			if err != nil {
-				fmt.Println(err)
-				return err
+			if d := currentDeltaRecorder(); d != nil {
+				if err := d.verifyDeltas(store, snapshot.ID, projectPath); err != nil {
+					writeCommandOut(err.Error()+"\n", projectPath, false)
+				}
 			}
+			snapshotMutex.Unlock()
 
-			commitID := -1
-			err = cIter.ForEach(func(_ *object.Commit) error {
-				commitID++
-				return nil
-			})
+			err, _ = createCounterHTML(counterMessage(snapshot.ID), couterHTMLPath)
 			if err != nil {
 				fmt.Println(err)
 				return err
 			}
-			// fmt.Println(commitID)
 
-			err, _ = createCounterHTML("ID: "+strconv.Itoa(commitID), couterHTMLPath)
-			if err != nil {
-				fmt.Println(err)
-				return err
+			if s := currentLiveServer(); s != nil {
+				if snapshots, err := loadSnapshotIndex(r, projectPath); err == nil {
+					go s.publishSnapshot(r, projectPath, snapshots)
+				}
+			}
+			if k := currentKata(); k != nil {
+				k.snapshot(snapshot.ID)
 			}
 
+			go runPostSnapshotHooks(config.Hooks.PostSnapshot, projectPath, SnapshotHookInput{
+				ID:    snapshot.ID,
+				Hash:  snapshot.Hash,
+				Time:  snapshot.Time,
+				Files: changedFiles,
+			})
+
 			// _, err = r.CommitObject(commit) 以下に貼り付ければライブモード
 			// ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
 			// client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
@@ -324,10 +419,12 @@ func createCounterHTML(message string, path string) (error, string) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		os.Exit(statusCommand(os.Args[2:]))
+	}
+
 	projectPath := ""
-	buffer := &bytes.Buffer{}
-	writer := buffer
-	liveStart = false
+	setLiveStarted(false)
 
 	fmt.Println("\x1b[32mWelcome Live Coding Capture! (v0.0.1)\x1b[0m")
 	err, couterHTMLPath := createCounterHTML("実況準備中", "")
@@ -336,48 +433,57 @@ func main() {
 	}
 
 	fmt.Println("Please open \"file://" + couterHTMLPath + "\" in your browser.")
+	go handleSignals(couterHTMLPath)
 	for {
 		pwd, err := os.Getwd()
 		if err != nil {
-			writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+			writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 			continue
 		}
 
 		home, err := os.UserHomeDir()
 		if err != nil {
-			writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+			writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 			continue
 		}
 
 		var liveStatus string
-		if liveStart {
+		if isLiveStarted() && isPaused() {
+			liveStatus = "paused"
+		} else if isLiveStarted() {
 			liveStatus = "recording"
+		} else if isArmed() {
+			liveStatus = "armed"
 		} else {
 			liveStatus = "stopped"
 		}
 
 		currentPath := strings.Replace(pwd, home, "~", 1)
-		scanner := bufio.NewScanner(os.Stdin)
+		newInterrupt(projectPath)
 		fmt.Printf("\x1b[34m%s\x1b[0m \x1b[31m(%s)\x1b[0m %s ", currentPath, liveStatus, "$")
-		scanner.Scan()
-		line := scanner.Text()
+		line, ok := readLine(interrupted())
+		if !ok {
+			fmt.Println()
+			continue
+		}
 
 		cmdSplit := strings.Split(line, " ")
 		cmdSplit = remove(cmdSplit, "")
 
 		if len(cmdSplit) > 0 {
+			touchActivity(projectPath, couterHTMLPath)
 			firstCommandName := cmdSplit[0]
 			if firstCommandName == "cd" {
-				writeCommandInput(line, projectPath, liveStart)
+				writeCommandInput(line, projectPath, isLiveStarted())
 				if len(cmdSplit) == 1 {
 					home, err := os.UserHomeDir()
 					if err != nil {
-						writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+						writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 						continue
 					}
 					err = os.Chdir(home)
 					if err != nil {
-						writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+						writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 						continue
 					}
 					continue
@@ -387,7 +493,7 @@ func main() {
 					if secondCommandValue == "~" {
 						err := os.Chdir(home)
 						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+							writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 							continue
 						}
 						continue
@@ -395,26 +501,33 @@ func main() {
 
 					err := os.Chdir(secondCommandValue)
 					if err != nil {
-						writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+						writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 						continue
 					}
 					continue
 				} else {
-					writeCommandOut("cd args are invalid.\n", projectPath, liveStart)
+					writeCommandOut("cd args are invalid.\n", projectPath, isLiveStarted())
 					continue
 				}
 			} else if firstCommandName == "live" {
+				if len(cmdSplit) > 2 && cmdSplit[1] == "init" {
+					projectPath = liveInit(cmdSplit[2:], projectPath, couterHTMLPath)
+					continue
+				}
+				if len(cmdSplit) == 3 && cmdSplit[1] == "arm" {
+					projectPath = liveArm(cmdSplit[2], projectPath, couterHTMLPath)
+					continue
+				}
+				if liveSubcommand(line, cmdSplit, projectPath, couterHTMLPath) {
+					continue
+				}
 				if len(cmdSplit) == 2 {
 					secondCommandValue := cmdSplit[1]
 					if secondCommandValue == "stop" {
-						liveStart = false
-						continue
-					} else if secondCommandValue == "status" {
-						if liveStart {
-							writeCommandOut("live is started.\n", projectPath, false)
-						} else {
-							writeCommandOut("live is stopped.\n", projectPath, false)
-						}
+						writeEvent(Event{Type: "stop"}, projectPath, isLiveStarted())
+						stopControlSocket()
+						setLiveStarted(false)
+						disarm()
 						continue
 					} else {
 						liveCommandUsage(projectPath)
@@ -423,58 +536,19 @@ func main() {
 				} else if len(cmdSplit) == 3 {
 					secondCommandValue := cmdSplit[1]
 					thirdCommandValue := cmdSplit[2]
-					if secondCommandValue == "init" {
-						if liveStart {
-							writeCommandOut("live is already started.\n", projectPath, liveStart)
-							continue
-						}
-						absPath, err := filepath.Abs(thirdCommandValue)
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-						if _, err := os.Stat(absPath); !os.IsNotExist(err) {
-							writeCommandOut("can't live in the path.\n", projectPath, liveStart)
-							continue
-						}
-
-						if err := os.Mkdir(absPath, 0751); err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-
-						projectPath = absPath
-
-						r, err := git.PlainInit(projectPath, false)
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-
-						liveStart = true
-
-						go watch(r, projectPath, couterHTMLPath)
-
-						err = os.Chdir(projectPath)
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-
-						continue
-					} else if secondCommandValue == "start" {
-						if liveStart {
+					if secondCommandValue == "start" {
+						if isLiveStarted() {
 							writeCommandOut("live is already started.\n", projectPath, false)
 							continue
 						}
 						absPath, err := filepath.Abs(thirdCommandValue)
 						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+							writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 							continue
 						}
 
 						if _, err := os.Stat(absPath); os.IsNotExist(err) {
-							writeCommandOut("File doesn't exists\n", projectPath, liveStart)
+							writeCommandOut("File doesn't exists\n", projectPath, isLiveStarted())
 							continue
 						}
 
@@ -484,135 +558,20 @@ func main() {
 
 						r, err := git.PlainOpen(projectPath)
 						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+							writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 							continue
 						}
 
-						liveStart = true
-
-						go watch(r, projectPath, couterHTMLPath)
+						startLive(r, projectPath, couterHTMLPath)
 
 						err = os.Chdir(projectPath)
 						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
+							writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
 							continue
 						}
 					} else if secondCommandValue == "upload" {
-						if liveStart {
-							writeCommandOut("you should stop live before.\n", projectPath, false)
-							continue
-						}
-
-						absPath, err := filepath.Abs(thirdCommandValue)
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-
-						if _, err := os.Stat(absPath); os.IsNotExist(err) {
-							writeCommandOut("File doesn't exists\n", projectPath, liveStart)
-							continue
-						}
-
-						projectPath = absPath
-
-						// fmt.Println(projectPath)
-
-						// if _, err = os.Stat(gitDirPath); os.IsNotExist(err) {
-						// 	writeCommandOut(".git directory not found\n", projectPath, liveStart)
-						// 	continue
-						// }
-
-						_, err = git.PlainOpen(projectPath)
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-
-						writeCommandOut("preparing to upload ...\n", projectPath, liveStart)
-
-						projectName := filepath.Base(projectPath)
-
-						// gitDirPath := projectName + "/.git"
-
-						prevDir, err := filepath.Abs(".")
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-
-						err = os.Chdir(projectName)
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-
-						var buf bytes.Buffer
-						err = compress(".git", &buf)
-						if err != nil {
-							writeCommandOut("compress .git-directory failed\n", projectPath, liveStart)
-							continue
-						}
-
-						err = os.Chdir(prevDir)
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-
-						writeCommandOut("uploading ...\n", projectPath, liveStart)
-
-						// r := bytes.NewReader(buf)
-
-						req, err := http.NewRequest("POST", "https://live-coding-api.takukitamura.com/api/live/upload?projectName="+projectName, &buf)
-						req.Header.Set("Content-Type", "application/gzip")
-
-						client := &http.Client{}
-						res, err := client.Do(req)
-						if err != nil {
-							writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-							continue
-						}
-						defer res.Body.Close()
-
-						bodyBytes, err := ioutil.ReadAll(res.Body)
-						if err != nil {
-							log.Fatal(err)
-						}
-						if res.StatusCode == http.StatusInternalServerError {
-							errorsResponse := ErrorsResponse{}
-							err = json.Unmarshal(bodyBytes, &errorsResponse)
-							if err != nil {
-								writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-								continue
-							}
-							if len(errorsResponse) != 1 {
-								writeCommandOut("error response is invalid\n", projectPath, liveStart)
-								continue
-							}
-							writeCommandOut(errorsResponse[0].Message+"\n", projectPath, liveStart)
-							continue
-						} else if res.StatusCode == http.StatusOK {
-							uploadsResponse := UploadsResponse{}
-							err = json.Unmarshal(bodyBytes, &uploadsResponse)
-							// fmt.Println(uploadsResponse)
-							if err != nil {
-								writeCommandOut(err.Error()+"\n", projectPath, liveStart)
-								continue
-							}
-
-							if len(uploadsResponse) != 1 {
-								writeCommandOut("upload response is invalid\n", projectPath, liveStart)
-								continue
-							}
-							uploadedURL := uploadsResponse[0].URL
-							writeCommandOut("done!\n", projectPath, liveStart)
-							writeCommandOut("you can see your live-coding in \""+uploadedURL+"\"\n", projectPath, liveStart)
-							continue
-						} else {
-							writeCommandOut("error code is unknown\n", projectPath, liveStart)
-							continue
-						}
+						liveUpload(thirdCommandValue, projectPath)
+						continue
 					} else {
 						liveCommandUsage(projectPath)
 						continue
@@ -621,17 +580,17 @@ func main() {
 					liveCommandUsage(projectPath)
 					continue
 				}
+			} else if firstCommandName == "fg" {
+				writeCommandInput(line, projectPath, isLiveStarted())
+				resumeCommand(projectPath, couterHTMLPath)
 			} else {
-				writeCommandInput(line, projectPath, liveStart)
-				cmd := exec.Command("bash", "-c", line)
-				cmd.Stdout = writer
-				cmd.Stderr = writer
-
-				cmd.Run()
-				out := buffer.String()
-				buffer.Reset()
-
-				writeCommandOut(out, projectPath, liveStart)
+				writeCommandInput(line, projectPath, isLiveStarted())
+				f, err := startCommand(line)
+				if err != nil {
+					writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+					continue
+				}
+				waitCommand(f, projectPath, couterHTMLPath)
 			}
 		}
 
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// liveSubcommand runs the live subcommands that take a variable number of
+// arguments. It returns false if cmdSplit is not one of them. line is the
+// line as typed, for the commands that take the rest of it as it is.
+func liveSubcommand(line string, cmdSplit []string, projectPath string, couterHTMLPath string) bool {
+	if len(cmdSplit) < 2 {
+		return false
+	}
+	args := cmdSplit[2:]
+	switch cmdSplit[1] {
+	case "login":
+		liveLogin(args, projectPath)
+	case "unpublish":
+		liveUnpublish(args, projectPath)
+	case "visibility":
+		liveVisibility(args, projectPath)
+	case "blame":
+		liveBlame(args, projectPath)
+	case "status":
+		liveStatus(args, line, projectPath)
+	case "stats":
+		liveStats(args, projectPath)
+	case "mark":
+		liveMark(args, projectPath)
+	case "note":
+		liveNote(args, projectPath)
+	case "replay":
+		liveReplay(args, projectPath)
+	case "serve":
+		liveServe(args, projectPath)
+	case "grep":
+		liveGrep(args, line, projectPath)
+	case "bisect":
+		liveBisect(args, projectPath)
+	case "restore":
+		liveRestore(args, projectPath, couterHTMLPath)
+	case "compare":
+		liveCompare(args, projectPath)
+	case "store":
+		liveStore(args, projectPath)
+	case "pack":
+		livePack(args, projectPath)
+	case "unpack":
+		liveUnpack(args, projectPath)
+	case "perform":
+		livePerform(args, projectPath)
+	case "merge":
+		liveMerge(args, projectPath)
+	case "export":
+		liveExport(args, projectPath)
+	default:
+		return false
+	}
+	return true
+}
+
+// openLiveRepository opens the project being captured, or the current
+// directory if nothing has been started yet.
+func openLiveRepository(projectPath string) (*git.Repository, string, error) {
+	if projectPath == "" {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return nil, "", err
+		}
+		projectPath = pwd
+	}
+	r, err := git.PlainOpen(projectPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return r, projectPath, nil
+}
+
+// live init [--template name] <path>
+//
+// liveInit returns the project path, which is the new project once its
+// directory is made.
+func liveInit(args []string, projectPath string, couterHTMLPath string) string {
+	args, templateName, _ := flagValue(args, "--template")
+	if len(args) != 1 {
+		writeCommandOut("usage: live init [--template name] <path>\n", projectPath, false)
+		return projectPath
+	}
+	if isLiveStarted() {
+		writeCommandOut("live is already started.\n", projectPath, isLiveStarted())
+		return projectPath
+	}
+	absPath, err := filepath.Abs(args[0])
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return projectPath
+	}
+	if _, err := os.Stat(absPath); !os.IsNotExist(err) {
+		writeCommandOut("can't live in the path.\n", projectPath, isLiveStarted())
+		return projectPath
+	}
+	template := KataTemplate{}
+	if templateName != "" {
+		if template, err = loadKataTemplate(templateName); err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+			return projectPath
+		}
+	}
+
+	if err := os.Mkdir(absPath, 0751); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return projectPath
+	}
+
+	projectPath = absPath
+
+	r, err := git.PlainInit(projectPath, false)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return projectPath
+	}
+	if templateName != "" {
+		if err := scaffoldKata(projectPath, templateName, template); err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+			return projectPath
+		}
+		out := "kata " + templateName + ": " + template.Description + "\n"
+		if !template.Hidden {
+			out += "test: " + template.Test + "\n"
+		}
+		if template.TimeLimit > 0 {
+			out += "time limit: " + formatSeconds(float64(template.TimeLimit)) + "\n"
+		}
+		writeCommandOut(out, projectPath, false)
+	}
+
+	startLive(r, projectPath, couterHTMLPath)
+
+	if err := os.Chdir(projectPath); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+	}
+	return projectPath
+}
+
+// projectRelPath turns a path typed in the shell into a slash separated
+// path inside the project.
+func projectRelPath(projectPath string, path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(projectPath, absPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func hasFlag(args []string, flag string) ([]string, bool) {
+	found := false
+	rest := []string{}
+	for _, arg := range args {
+		if arg == flag {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, found
+}
+
+// restOfLine returns line without its first n words, keeping the spaces
+// between the words after them.
+func restOfLine(line string, n int) string {
+	rest := strings.TrimLeft(line, " ")
+	for i := 0; i < n; i++ {
+		end := strings.Index(rest, " ")
+		if end < 0 {
+			return ""
+		}
+		rest = strings.TrimLeft(rest[end:], " ")
+	}
+	return rest
+}
+
+// unquote strips the quotes around s, as a shell would around a single
+// word, so that an argument typed at the prompt can be quoted the same way
+// as in a shell.
+func unquote(s string) string {
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] {
+		return s
+	}
+	inner := s[1 : len(s)-1]
+	if s[0] == '"' {
+		inner = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(inner)
+	}
+	return inner
+}
+
+// flagValue removes "flag value" from args and returns the value.
+func flagValue(args []string, flag string) ([]string, string, bool) {
+	value := ""
+	found := false
+	rest := []string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] == flag && i+1 < len(args) {
+			value = args[i+1]
+			found = true
+			i++
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+	return rest, value, found
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+)
+
+// LocalStore keeps snapshots in .git/live/store. Files and trees are
+// objects named by the sha256 of their contents, and an append-only
+// key-value index holds the snapshots and the size and time of every file
+// at its last snapshot, so that only the files that were touched are read
+// again. It does no more work per snapshot than the files changed, where
+// git runs "git add ." and walks its whole index.
+type LocalStore struct {
+	mutex     sync.Mutex
+	root      string
+	dir       string
+	index     *KVIndex
+	snapshots Snapshots
+	trees     []string
+}
+
+// FileStat is what the local store remembers of a file to tell whether it
+// changed without reading it.
+type FileStat struct {
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Hash    string      `json:"hash"`
+}
+
+// LocalSnapshot is the value of "snapshot/<id>" in the index.
+type LocalSnapshot struct {
+	Snapshot
+	Tree string `json:"tree"`
+}
+
+const LOCAL_STORE_DIR = "store"
+const LOCAL_STORE_INDEX = "index"
+const LOCAL_STORE_OBJECTS = "objects"
+
+// a file modified this close to a scan may change again within the same
+// modification time, so its stat is not remembered
+const LOCAL_STORE_RACY_TIME = 2 * time.Second
+
+var localStoresMutex sync.Mutex
+
+// localStores has one store per project, shared by watch() and the
+// commands run from the prompt.
+var localStores = map[string]*LocalStore{}
+
+func openLocalStore(projectPath string) (*LocalStore, error) {
+	localStoresMutex.Lock()
+	defer localStoresMutex.Unlock()
+	if s, ok := localStores[projectPath]; ok {
+		return s, nil
+	}
+
+	dir := liveDataPath(projectPath, LOCAL_STORE_DIR)
+	if err := os.MkdirAll(filepath.Join(dir, LOCAL_STORE_OBJECTS), 0755); err != nil {
+		return nil, err
+	}
+	index, err := openKVIndex(filepath.Join(dir, LOCAL_STORE_INDEX))
+	if err != nil {
+		return nil, err
+	}
+	s := &LocalStore{root: projectPath, dir: dir, index: index, snapshots: Snapshots{}, trees: []string{}}
+	for id := 0; ; id++ {
+		value, ok := index.Get("snapshot/" + strconv.Itoa(id))
+		if !ok {
+			break
+		}
+		snapshot := LocalSnapshot{}
+		if err := json.Unmarshal([]byte(value), &snapshot); err != nil {
+			return nil, err
+		}
+		s.snapshots = append(s.snapshots, snapshot.Snapshot)
+		s.trees = append(s.trees, snapshot.Tree)
+	}
+	localStores[projectPath] = s
+	return s, nil
+}
+
+func (s *LocalStore) objectPath(hash string) string {
+	return filepath.Join(s.dir, LOCAL_STORE_OBJECTS, hash[:2], hash[2:])
+}
+
+// writeObject stores data compressed and returns its hash. An object that
+// is already there is not written again.
+func (s *LocalStore) writeObject(data []byte) (string, error) {
+	hash := checksum(data)
+	path := s.objectPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0444); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp, path)
+}
+
+func (s *LocalStore) Blob(hash string) ([]byte, error) {
+	if len(hash) < 3 {
+		return nil, errors.New("object " + hash + " doesn't exist")
+	}
+	file, err := os.Open(s.objectPath(hash))
+	if os.IsNotExist(err) {
+		return nil, errors.New("object " + hash + " doesn't exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+func (s *LocalStore) tree(id int) (SnapshotFiles, error) {
+	files := SnapshotFiles{}
+	if id < 0 {
+		return files, nil
+	}
+	data, err := s.Blob(s.trees[id])
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &files)
+	return files, err
+}
+
+// scan reads the work tree the way "git add ." would see it. Files whose
+// size, modification time and mode are the same as at their last scan are
+// not read. It returns the files and the stats to remember.
+func (s *LocalStore) scan() (SnapshotFiles, map[string]string, error) {
+	files := SnapshotFiles{}
+	stats := map[string]string{}
+	patterns, err := gitignore.ReadPatterns(osfs.New(s.root), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	matcher := gitignore.NewMatcher(patterns)
+	racy := time.Now().Add(-LOCAL_STORE_RACY_TIME).UnixNano()
+
+	err = filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if info.Name() == ".git" || matcher.Match(strings.Split(rel, "/"), true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || matcher.Match(strings.Split(rel, "/"), false) {
+			return nil
+		}
+
+		mode := os.FileMode(0644)
+		if info.Mode()&0111 != 0 {
+			mode = 0755
+		}
+		stat := FileStat{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Mode: mode}
+		if value, ok := s.index.Get("stat/" + rel); ok {
+			known := FileStat{}
+			if json.Unmarshal([]byte(value), &known) == nil && known.Size == stat.Size && known.ModTime == stat.ModTime && known.Mode == stat.Mode {
+				files[rel] = StoredFile{Hash: known.Hash, Mode: mode}
+				return nil
+			}
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		stat.Hash, err = s.writeObject(data)
+		if err != nil {
+			return err
+		}
+		files[rel] = StoredFile{Hash: stat.Hash, Mode: mode}
+		if stat.ModTime < racy {
+			value, err := json.Marshal(stat)
+			if err != nil {
+				return err
+			}
+			stats["stat/"+rel] = string(value)
+		}
+		return nil
+	})
+	return files, stats, err
+}
+
+func changedFiles(before SnapshotFiles, after SnapshotFiles) []string {
+	changed := []string{}
+	for path, f := range after {
+		if before[path] != f {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func (s *LocalStore) Changes() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files, stats, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.index.Put(stats); err != nil {
+		return nil, err
+	}
+	latest, err := s.tree(len(s.snapshots) - 1)
+	if err != nil {
+		return nil, err
+	}
+	return changedFiles(latest, files), nil
+}
+
+// add appends a snapshot of files to the store, along with the other
+// index entries in batch.
+func (s *LocalStore) add(t int64, label string, files SnapshotFiles, batch map[string]string) (Snapshot, error) {
+	data, err := json.Marshal(files)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	tree, err := s.writeObject(data)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	parent := ""
+	if len(s.snapshots) > 0 {
+		parent = s.snapshots[len(s.snapshots)-1].Hash
+	}
+	snapshot := LocalSnapshot{
+		Snapshot: Snapshot{
+			ID:    len(s.snapshots),
+			Hash:  checksum([]byte(parent + "\n" + tree + "\n" + snapshotMessage(t, label))),
+			Time:  t,
+			Label: label,
+		},
+		Tree: tree,
+	}
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	batch["snapshot/"+strconv.Itoa(snapshot.ID)] = string(value)
+	if err := s.index.Put(batch); err != nil {
+		return Snapshot{}, err
+	}
+	s.snapshots = append(s.snapshots, snapshot.Snapshot)
+	s.trees = append(s.trees, tree)
+	return snapshot.Snapshot, nil
+}
+
+func (s *LocalStore) Put(t int64, label string) (Snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files, stats, err := s.scan()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return s.add(t, label, files, stats)
+}
+
+// importSnapshot copies a snapshot of another store, with its time and
+// label.
+func (s *LocalStore) importSnapshot(from SnapshotStore, snapshot Snapshot, files SnapshotFiles) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	imported := SnapshotFiles{}
+	for name, f := range files {
+		data, err := from.Blob(f.Hash)
+		if err != nil {
+			return err
+		}
+		hash, err := s.writeObject(data)
+		if err != nil {
+			return err
+		}
+		imported[name] = StoredFile{Hash: hash, Mode: f.Mode}
+	}
+	_, err := s.add(snapshot.Time, snapshot.Label, imported, map[string]string{})
+	return err
+}
+
+func (s *LocalStore) Get(id int) (Snapshot, SnapshotFiles, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if id < 0 || id >= len(s.snapshots) {
+		return Snapshot{}, nil, errors.New("snapshot " + strconv.Itoa(id) + " doesn't exist")
+	}
+	files, err := s.tree(id)
+	return s.snapshots[id], files, err
+}
+
+func (s *LocalStore) List(from int, to int) (Snapshots, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return snapshotRange(s.snapshots, from, to), nil
+}
+
+func (s *LocalStore) Len() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.snapshots), nil
+}
+
+// KVIndex is a key-value index kept in memory and appended to a file, one
+// JSON line per change. A line ["key"] deletes the key. The file is
+// rewritten when most of its lines are outdated.
+type KVIndex struct {
+	mutex  sync.Mutex
+	path   string
+	values map[string]string
+	lines  int
+}
+
+const KV_INDEX_COMPACT_LINES = 1000
+
+func openKVIndex(path string) (*KVIndex, error) {
+	kv := &KVIndex{path: path, values: map[string]string{}}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return kv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := []string{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// a line cut short by a crash is the last one, drop it
+			break
+		}
+		kv.lines++
+		switch len(record) {
+		case 1:
+			delete(kv.values, record[0])
+		case 2:
+			kv.values[record[0]] = record[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if kv.lines > KV_INDEX_COMPACT_LINES && kv.lines > 2*len(kv.values) {
+		if err := kv.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return kv, nil
+}
+
+func (kv *KVIndex) Get(key string) (string, bool) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	value, ok := kv.values[key]
+	return value, ok
+}
+
+// Put writes the batch with one write. An empty value deletes the key.
+func (kv *KVIndex) Put(batch map[string]string) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	keys := []string{}
+	for key := range batch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf := bytes.Buffer{}
+	for _, key := range keys {
+		record := []string{key}
+		if batch[key] != "" {
+			record = append(record, batch[key])
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+
+	file, err := os.OpenFile(kv.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if batch[key] == "" {
+			delete(kv.values, key)
+		} else {
+			kv.values[key] = batch[key]
+		}
+	}
+	kv.lines += len(keys)
+	return nil
+}
+
+func (kv *KVIndex) compact() error {
+	keys := []string{}
+	for key := range kv.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf := bytes.Buffer{}
+	for _, key := range keys {
+		line, err := json.Marshal([]string{key, kv.values[key]})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := kv.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	kv.lines = len(keys)
+	return os.Rename(tmp, kv.path)
+}
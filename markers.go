@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Marker is a "live mark" event. Snapshot is the latest snapshot at the
+// time the mark was made.
+type Marker struct {
+	Label    string `json:"label"`
+	Time     int64  `json:"time"`
+	Snapshot int    `json:"snapshot"`
+}
+
+func sessionMarkers(events Events) []Marker {
+	markers := []Marker{}
+	for _, e := range events {
+		if e.Type == "mark" {
+			markers = append(markers, Marker{Label: e.Label, Time: e.Time, Snapshot: e.Snapshot})
+		}
+	}
+	return markers
+}
+
+// live mark <label>
+func liveMark(args []string, projectPath string) {
+	if len(args) == 0 {
+		writeCommandOut("usage: live mark <label>\n", projectPath, false)
+		return
+	}
+	if isLiveStarted() == false {
+		writeCommandOut("live is stopped.\n", projectPath, false)
+		return
+	}
+	event := Event{Type: "mark", Label: strings.Join(args, " ")}
+	if info, err := os.Stat(filepath.Join(projectPath, CUI_LOG)); err == nil {
+		event.LogOffset = info.Size()
+	}
+	writeEvent(event, projectPath, isLiveStarted())
+}
+
+// live note <text>
+func liveNote(args []string, projectPath string) {
+	if len(args) == 0 {
+		writeCommandOut("usage: live note <text>\n", projectPath, false)
+		return
+	}
+	if isLiveStarted() == false {
+		writeCommandOut("live is stopped.\n", projectPath, false)
+		return
+	}
+	writeEvent(Event{Type: "note", Label: strings.Join(args, " ")}, projectPath, isLiveStarted())
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+// MergeSource is one of the sessions given to "live merge".
+type MergeSource struct {
+	Author    string
+	r         *git.Repository
+	Snapshots Snapshots
+	Events    Events
+}
+
+// MergeChange is what a snapshot of one source changed since the previous
+// snapshot of the same source, which was taken at Start. Removed files
+// are nil.
+type MergeChange struct {
+	Source   int
+	Snapshot int
+	Start    int64
+	Time     int64
+	Files    map[string]*object.File
+}
+
+// MergeConflict is a file two authors changed at the same time: each
+// changed it between two of their snapshots, and the two periods overlap.
+// It is also a file the first snapshot of an author has in another
+// version than the merged tree at that time.
+type MergeConflict struct {
+	File     string
+	Authors  [2]string
+	Time     int64
+	Snapshot int
+}
+
+// mergeSourceArg splits "path=author". The author defaults to the name of
+// the project or archive.
+func mergeSourceArg(arg string) (string, string) {
+	if i := strings.LastIndex(arg, "="); i > 0 && i < len(arg)-1 {
+		return arg[:i], arg[i+1:]
+	}
+	name := filepath.Base(strings.TrimSuffix(arg, "/"))
+	return arg, strings.TrimSuffix(name, SESSION_EXTENSION)
+}
+
+func sourceChanges(source *MergeSource, index int) ([]MergeChange, error) {
+	changes := []MergeChange{}
+	previous := map[string]*object.File{}
+	start := int64(0)
+	for i, s := range source.Snapshots {
+		tree, err := snapshotTreeFiles(source.r, s)
+		if err != nil {
+			return nil, err
+		}
+		change := MergeChange{Source: index, Snapshot: i, Start: start, Time: s.Time, Files: map[string]*object.File{}}
+		if i == 0 {
+			change.Start = s.Time
+		}
+		for path, f := range tree {
+			if p, ok := previous[path]; !ok || p.Hash != f.Hash || p.Mode != f.Mode {
+				change.Files[path] = f
+			}
+		}
+		for path := range previous {
+			if _, ok := tree[path]; !ok {
+				change.Files[path] = nil
+			}
+		}
+		changes = append(changes, change)
+		previous = tree
+		start = s.Time
+	}
+	return changes, nil
+}
+
+// mergeConflicts finds the files changed by two authors in overlapping
+// periods. The first snapshots, which are not edits but the starting copy
+// of an author, are checked by mergeSessions. The terminal log, which
+// everyone writes to, is left out.
+func mergeConflicts(sources []*MergeSource, changes []MergeChange) []MergeConflict {
+	byFile := map[string][]MergeChange{}
+	for _, c := range changes {
+		if c.Snapshot == 0 {
+			continue
+		}
+		for path := range c.Files {
+			if path != CUI_LOG {
+				byFile[path] = append(byFile[path], c)
+			}
+		}
+	}
+
+	conflicts := []MergeConflict{}
+	for path, fileChanges := range byFile {
+		for i, a := range fileChanges {
+			for _, b := range fileChanges[i+1:] {
+				if a.Source == b.Source || a.Start >= b.Time || b.Start >= a.Time {
+					continue
+				}
+				first, second := a, b
+				if second.Time < first.Time {
+					first, second = second, first
+				}
+				conflicts = append(conflicts, MergeConflict{
+					File:    path,
+					Authors: [2]string{sources[first.Source].Author, sources[second.Source].Author},
+					Time:    second.Time,
+				})
+			}
+		}
+	}
+	sortConflicts(conflicts)
+	return conflicts
+}
+
+func sortConflicts(conflicts []MergeConflict) {
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Time != conflicts[j].Time {
+			return conflicts[i].Time < conflicts[j].Time
+		}
+		return conflicts[i].File < conflicts[j].File
+	})
+}
+
+// copyBlob stores the contents of f in s, unless they are already there.
+func copyBlob(f *object.File, s storage.Storer) (plumbing.Hash, error) {
+	if _, err := s.EncodedObject(plumbing.BlobObject, f.Hash); err == nil {
+		return f.Hash, nil
+	}
+	reader, err := f.Reader()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer reader.Close()
+
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	writer, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	writer.Close()
+	return s.SetEncodedObject(obj)
+}
+
+// mergedSnapshotAt returns the merged snapshot that was the latest at t.
+func mergedSnapshotAt(times []int64, t int64) int {
+	i := sort.Search(len(times), func(i int) bool { return times[i] > t })
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// mergeSessions writes the snapshots of every source, in time order, as
+// the commits of a new project in dir. Each snapshot brings the files its
+// author changed into the tree, so the last one to change a file wins.
+// The first snapshot of an author is where they started from, not their
+// edits: it only adds the files the tree does not have yet, and a file it
+// has in another version is a conflict, so that a late starter never
+// puts back what the others have changed since.
+func mergeSessions(sources []*MergeSource, dir string) ([]MergeConflict, int, error) {
+	changes := []MergeChange{}
+	for i, source := range sources {
+		c, err := sourceChanges(source, i)
+		if err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, c...)
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Time < changes[j].Time })
+	conflicts := mergeConflicts(sources, changes)
+
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	tree := map[string]treeFile{}
+	owners := map[string]int{}
+	parent := plumbing.ZeroHash
+	times := []int64{}
+	for _, c := range changes {
+		for path, f := range c.Files {
+			if f == nil {
+				delete(tree, path)
+				continue
+			}
+			if current, ok := tree[path]; ok && c.Snapshot == 0 {
+				if path != CUI_LOG && (current.hash != f.Hash || current.mode != f.Mode) {
+					conflicts = append(conflicts, MergeConflict{
+						File:    path,
+						Authors: [2]string{sources[owners[path]].Author, sources[c.Source].Author},
+						Time:    c.Time,
+					})
+				}
+				continue
+			}
+			hash, err := copyBlob(f, r.Storer)
+			if err != nil {
+				return nil, 0, err
+			}
+			tree[path] = treeFile{hash: hash, mode: f.Mode}
+			owners[path] = c.Source
+		}
+		treeHash, err := writeTree(r.Storer, tree)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		source := sources[c.Source]
+		signature := object.Signature{Name: source.Author, When: time.Unix(0, c.Time)}
+		commit := &object.Commit{Author: signature, Committer: signature, Message: snapshotMessage(c.Time, source.Snapshots[c.Snapshot].Label), TreeHash: treeHash}
+		if !parent.IsZero() {
+			commit.ParentHashes = []plumbing.Hash{parent}
+		}
+		obj := r.Storer.NewEncodedObject()
+		if err := commit.Encode(obj); err != nil {
+			return nil, 0, err
+		}
+		if parent, err = r.Storer.SetEncodedObject(obj); err != nil {
+			return nil, 0, err
+		}
+		times = append(times, c.Time)
+	}
+	sortConflicts(conflicts)
+	if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.Master, parent)); err != nil {
+		return nil, 0, err
+	}
+	if out, err := exec.Command("git", "-C", dir, "reset", "-q", "--hard").CombinedOutput(); err != nil {
+		return nil, 0, errors.New(strings.TrimSpace(string(out)))
+	}
+	if _, err := loadGitSnapshotIndex(r, dir); err != nil {
+		return nil, 0, err
+	}
+
+	events := Events{}
+	for _, source := range sources {
+		for _, e := range source.Events {
+			e.Author = source.Author
+			e.Snapshot = mergedSnapshotAt(times, e.Time)
+			events = append(events, e)
+		}
+	}
+	for i, c := range conflicts {
+		conflicts[i].Snapshot = mergedSnapshotAt(times, c.Time)
+		events = append(events, Event{
+			Time:     c.Time,
+			Type:     "conflict",
+			Snapshot: conflicts[i].Snapshot,
+			Label:    c.File,
+			Author:   c.Authors[0] + ", " + c.Authors[1],
+		})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time < events[j].Time })
+
+	lines := ""
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, 0, err
+		}
+		lines += string(data) + "\n"
+	}
+	if err := ioutil.WriteFile(liveDataPath(dir, EVENT_LOG), []byte(lines), 0644); err != nil {
+		return nil, 0, err
+	}
+	return conflicts, len(changes), nil
+}
+
+// live merge <dir> <session>[=author] <session>[=author]...
+func liveMerge(args []string, projectPath string) {
+	if len(args) < 3 {
+		writeCommandOut("usage: live merge <dir> <session>[=author] <session>[=author]...\n", projectPath, false)
+		return
+	}
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		writeCommandOut(dir+" already exists.\n", projectPath, false)
+		return
+	}
+
+	sources := []*MergeSource{}
+	authors := map[string]bool{}
+	for _, arg := range args[1:] {
+		path, author := mergeSourceArg(arg)
+		if authors[author] {
+			writeCommandOut("author "+author+" is given twice, name them with <session>=<author>.\n", projectPath, false)
+			return
+		}
+		authors[author] = true
+
+		r, root, cleanup, err := openSessionPath(path)
+		defer cleanup()
+		if err != nil {
+			writeCommandOut(path+": "+err.Error()+"\n", projectPath, false)
+			return
+		}
+		source := &MergeSource{Author: author, r: r}
+		if source.Snapshots, err = loadSnapshotIndex(r, root); err != nil {
+			writeCommandOut(path+": "+err.Error()+"\n", projectPath, false)
+			return
+		}
+		if source.Events, err = readEvents(root); err != nil {
+			writeCommandOut(path+": "+err.Error()+"\n", projectPath, false)
+			return
+		}
+		sources = append(sources, source)
+	}
+
+	conflicts, count, err := mergeSessions(sources, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	names := []string{}
+	for _, source := range sources {
+		names = append(names, source.Author)
+	}
+	out := fmt.Sprintf("merged %d snapshots of %s into %s.\n", count, strings.Join(names, ", "), dir)
+	if len(conflicts) > 0 {
+		out += "conflicts:\n"
+		for _, c := range conflicts {
+			out += fmt.Sprintf("  %s @%d %s  %s, %s\n", formatSnapshotTime(c.Time), c.Snapshot, c.File, c.Authors[0], c.Authors[1])
+		}
+	}
+	writeCommandOut(out, projectPath, false)
+}
@@ -0,0 +1,190 @@
+// mockserver is a local stand-in for the live upload service, to try
+// "live login", "live upload", "live unpublish" and "live visibility"
+// without touching the real one. Everything is kept in memory.
+//
+//	go run ./mockserver -addr localhost:8766 -tokens alice:secret1,bob:secret2
+//	live login --server http://localhost:8766
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+type UploadResponse struct {
+	URL string `json:"url"`
+}
+
+type Project struct {
+	Owner      string
+	Visibility string
+	Size       int
+}
+
+// ProjectKey names a project. Each user has projects of their own, so two
+// users can upload projects with the same name.
+type ProjectKey struct {
+	Owner string
+	Name  string
+}
+
+type MockServer struct {
+	mutex    sync.Mutex
+	addr     string
+	tokens   map[string]string
+	projects map[ProjectKey]*Project
+}
+
+func newMockServer(addr string) *MockServer {
+	return &MockServer{addr: addr, tokens: map[string]string{}, projects: map[ProjectKey]*Project{}}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, []ErrorResponse{{Message: message}})
+}
+
+// user returns the owner of the request's bearer token, or "".
+func (s *MockServer) user(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return s.tokens[token]
+}
+
+func (s *MockServer) handleUser(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "the token is invalid.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"name": user})
+}
+
+func (s *MockServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "you should login before, run \"live login\".")
+		return
+	}
+	name := r.URL.Query().Get("projectName")
+	if r.Method != "POST" || name == "" {
+		writeError(w, http.StatusBadRequest, "projectName is missing.")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	project, ok := s.projects[ProjectKey{Owner: user, Name: name}]
+	if !ok {
+		project = &Project{Owner: user, Visibility: "public"}
+		s.projects[ProjectKey{Owner: user, Name: name}] = project
+	}
+	project.Size = len(body)
+	log.Printf("%s uploaded %s (%d bytes)", user, name, len(body))
+	writeJSON(w, http.StatusOK, []UploadResponse{{URL: "http://" + s.addr + "/" + user + "/" + name}})
+}
+
+// handleProject serves DELETE /api/live/projects/<name> and
+// PUT /api/live/projects/<name>/visibility, on a project of the user's
+// own.
+func (s *MockServer) handleProject(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "you should login before, run \"live login\".")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/live/projects/")
+	name := strings.TrimSuffix(path, "/visibility")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := ProjectKey{Owner: user, Name: name}
+	project, ok := s.projects[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, name+" doesn't exist.")
+		return
+	}
+
+	switch {
+	case r.Method == "DELETE" && name == path:
+		delete(s.projects, key)
+		log.Printf("%s unpublished %s", user, name)
+		writeJSON(w, http.StatusOK, map[string]string{})
+	case r.Method == "PUT" && name != path:
+		request := struct {
+			Visibility string `json:"visibility"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || (request.Visibility != "private" && request.Visibility != "public") {
+			writeError(w, http.StatusBadRequest, "visibility must be private or public.")
+			return
+		}
+		project.Visibility = request.Visibility
+		log.Printf("%s made %s %s", user, name, request.Visibility)
+		writeJSON(w, http.StatusOK, map[string]string{})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed.")
+	}
+}
+
+// handleView answers GET /<owner>/<name> like the viewer would: private
+// projects are only found by their owner.
+func (s *MockServer) handleView(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	project, ok := s.projects[ProjectKey{Owner: parts[0], Name: parts[1]}]
+	if !ok || (project.Visibility == "private" && s.user(r) != project.Owner) {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"owner": project.Owner, "name": parts[1], "visibility": project.Visibility, "size": project.Size})
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8766", "address to listen on")
+	tokens := flag.String("tokens", "user:token", "comma separated user:token pairs")
+	flag.Parse()
+
+	s := newMockServer(*addr)
+	for _, pair := range strings.Split(*tokens, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			log.Fatal("tokens must look like user:token")
+		}
+		s.tokens[parts[1]] = parts[0]
+	}
+
+	log.Printf("mock upload service on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, s.handler()))
+}
+
+func (s *MockServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/user", s.handleUser)
+	mux.HandleFunc("/api/live/upload", s.handleUpload)
+	mux.HandleFunc("/api/live/projects/", s.handleProject)
+	mux.HandleFunc("/", s.handleView)
+	return mux
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := newMockServer("")
+	s.tokens["secret1"] = "alice"
+	s.tokens["secret2"] = "bob"
+	server := httptest.NewServer(s.handler())
+	t.Cleanup(server.Close)
+	s.addr = strings.TrimPrefix(server.URL, "http://")
+	return server
+}
+
+// request sends what the live client sends and returns the status code.
+func request(t *testing.T, server *httptest.Server, method string, path string, token string, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func upload(t *testing.T, server *httptest.Server, token string, name string, body string) string {
+	t.Helper()
+	req, err := http.NewRequest("POST", server.URL+"/api/live/upload?projectName="+name, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("upload of %s returned %d", name, res.StatusCode)
+	}
+	uploads := []UploadResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&uploads); err != nil || len(uploads) != 1 {
+		t.Fatalf("upload of %s returned %v (%v)", name, uploads, err)
+	}
+	return uploads[0].URL
+}
+
+func TestUploadUnpublishAndVisibility(t *testing.T) {
+	server := newTestServer(t)
+
+	if status := request(t, server, "POST", "/api/live/upload?projectName=kata", "wrong", "x"); status != http.StatusUnauthorized {
+		t.Errorf("upload with a wrong token returned %d", status)
+	}
+	aliceURL := upload(t, server, "secret1", "kata", "alice's")
+	bobURL := upload(t, server, "secret2", "kata", "bob's bigger")
+	if aliceURL == bobURL {
+		t.Fatalf("both projects are at %s", aliceURL)
+	}
+	if status := request(t, server, "GET", "/alice/kata", "", ""); status != http.StatusOK {
+		t.Errorf("alice/kata returned %d after bob uploaded a kata too", status)
+	}
+
+	// visibility only changes the uploader's own project
+	if status := request(t, server, "PUT", "/api/live/projects/kata/visibility", "secret1", `{"visibility": "hidden"}`); status != http.StatusBadRequest {
+		t.Errorf("an invalid visibility returned %d", status)
+	}
+	if status := request(t, server, "PUT", "/api/live/projects/kata/visibility", "secret1", `{"visibility": "private"}`); status != http.StatusOK {
+		t.Fatalf("making alice/kata private returned %d", status)
+	}
+	for _, view := range []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/alice/kata", "", http.StatusNotFound},
+		{"/alice/kata", "secret2", http.StatusNotFound},
+		{"/alice/kata", "secret1", http.StatusOK},
+		{"/bob/kata", "", http.StatusOK},
+	} {
+		if status := request(t, server, "GET", view.path, view.token, ""); status != view.status {
+			t.Errorf("%s with token %q returned %d, want %d", view.path, view.token, status, view.status)
+		}
+	}
+
+	// uploading again keeps the visibility
+	upload(t, server, "secret1", "kata", "alice's again")
+	if status := request(t, server, "GET", "/alice/kata", "", ""); status != http.StatusNotFound {
+		t.Errorf("alice/kata is public again after an upload")
+	}
+
+	if status := request(t, server, "DELETE", "/api/live/projects/kata", "secret2", ""); status != http.StatusOK {
+		t.Fatalf("unpublishing bob/kata returned %d", status)
+	}
+	if status := request(t, server, "GET", "/bob/kata", "", ""); status != http.StatusNotFound {
+		t.Errorf("bob/kata returned %d after it was unpublished", status)
+	}
+	if status := request(t, server, "GET", "/alice/kata", "secret1", ""); status != http.StatusOK {
+		t.Errorf("alice/kata returned %d after bob unpublished theirs", status)
+	}
+	if status := request(t, server, "DELETE", "/api/live/projects/kata", "secret2", ""); status != http.StatusNotFound {
+		t.Errorf("unpublishing bob/kata twice returned %d", status)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// SessionPatch is the squashed change of one marker range, in the mbox
+// format of "git format-patch".
+type SessionPatch struct {
+	Subject string
+	Text    string
+}
+
+var nonSlugCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+// patchFileName is the file name "git format-patch" would give the patch.
+func patchFileName(n int, subject string) string {
+	slug := strings.Trim(nonSlugCharacters.ReplaceAllString(strings.ToLower(subject), "-"), "-")
+	if len(slug) > 52 {
+		slug = strings.TrimRight(slug[:52], "-")
+	}
+	return fmt.Sprintf("%04d-%s.patch", n, slug)
+}
+
+// formatPatch writes the squashed patch of sr as patch n of total.
+func formatPatch(n int, total int, sr SnapshotRange, patch *object.Patch, c *object.Commit, snapshots Snapshots) string {
+	name := c.Author.Name
+	if name == "" {
+		name = "live"
+	}
+	email := c.Author.Email
+	if email == "" {
+		email = "live@localhost"
+	}
+
+	first := sr.From + 1
+	text := "From " + c.Hash.String() + " Mon Sep 17 00:00:00 2001\n"
+	text += "From: " + name + " <" + email + ">\n"
+	text += "Date: " + time.Unix(0, snapshots[sr.To].Time).Format(time.RFC1123Z) + "\n"
+	text += fmt.Sprintf("Subject: [PATCH %d/%d] %s\n\n", n, total, sr.Title)
+	text += fmt.Sprintf("Snapshots %d to %d of the live, %s to %s.\n", first, sr.To, formatSnapshotTime(snapshots[first].Time), formatSnapshotTime(snapshots[sr.To].Time))
+	return text + "---\n" + patch.Stats().String() + "\n" + patch.String() + "-- \nlive\n\n"
+}
+
+// sessionPatches squashes the snapshots between markers into one patch per
+// marker, with the marker label as the subject. Ranges without changes
+// are left out.
+func sessionPatches(r *git.Repository, snapshots Snapshots, events Events) ([]SessionPatch, error) {
+	markers := sessionMarkers(events)
+	if len(markers) == 0 {
+		return nil, errors.New("there are no markers, add some with \"live mark <label>\"")
+	}
+
+	ranges := []SnapshotRange{}
+	filePatches := []*object.Patch{}
+	for _, sr := range markerRanges(snapshots, markers, "Wrap up") {
+		if sr.To < 0 || sr.To <= sr.From {
+			continue
+		}
+		patch, err := snapshotRangePatch(r, snapshots, sr.From, sr.To)
+		if err != nil {
+			return nil, err
+		}
+		if len(patch.FilePatches()) > 0 {
+			ranges = append(ranges, sr)
+			filePatches = append(filePatches, patch)
+		}
+	}
+
+	patches := []SessionPatch{}
+	for i, sr := range ranges {
+		c, err := snapshotCommit(r, snapshots[sr.To])
+		if err != nil {
+			return nil, err
+		}
+		text := formatPatch(i+1, len(ranges), sr, filePatches[i], c, snapshots)
+		patches = append(patches, SessionPatch{Subject: sr.Title, Text: text})
+	}
+	return patches, nil
+}
+
+// live export patches [-o dir]
+func exportPatches(args []string, projectPath string) {
+	args, outputDir, _ := flagValue(args, "-o")
+	if len(args) != 0 {
+		writeCommandOut("usage: live export patches [-o dir]\n", projectPath, false)
+		return
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	events, err := readEvents(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	patches, err := sessionPatches(r, snapshots, events)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if len(patches) == 0 {
+		writeCommandOut("there are no changes to export.\n", projectPath, false)
+		return
+	}
+
+	if outputDir == "" {
+		out := ""
+		for _, p := range patches {
+			out += p.Text
+		}
+		writeCommandOut(out, projectPath, false)
+		return
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	for i, p := range patches {
+		writeExport(p.Text, filepath.Join(outputDir, patchFileName(i+1, p.Subject)), projectPath)
+	}
+}
+
+// live export bundle -o file
+func exportBundle(args []string, projectPath string) {
+	args, outputPath, _ := flagValue(args, "-o")
+	if len(args) != 0 || outputPath == "" {
+		writeCommandOut("usage: live export bundle -o file\n", projectPath, false)
+		return
+	}
+
+	_, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	absPath, err := filepath.Abs(outputPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	snapshotMutex.Lock()
+	cmd := exec.Command("git", "bundle", "create", absPath, "HEAD", "--branches")
+	cmd.Dir = root
+	out, err := cmd.CombinedOutput()
+	snapshotMutex.Unlock()
+	if err != nil {
+		writeCommandOut(string(out), projectPath, false)
+		return
+	}
+	writeCommandOut("wrote "+outputPath+", clone it with \"git clone "+outputPath+"\".\n", projectPath, false)
+}
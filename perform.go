@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// PerformStep is one thing "live perform" does at Time: write the tree of
+// a snapshot, apply a delta, show or run a recorded command, or stop at a
+// marker.
+type PerformStep struct {
+	Time     int64
+	Kind     string
+	Snapshot int
+	Delta    Delta
+	Event    Event
+}
+
+// Performer recreates a session in dir. Files holds the text of every file
+// written so far, deltas are applied to it. With repair a check that finds
+// dir different from the snapshot writes the snapshot back instead of
+// failing.
+type Performer struct {
+	r           *git.Repository
+	dir         string
+	snapshots   Snapshots
+	files       map[string]string
+	modes       map[string]os.FileMode
+	run         bool
+	repair      bool
+	projectPath string
+}
+
+const PERFORM_SNAPSHOT = "snapshot"
+const PERFORM_DELTA = "delta"
+const PERFORM_COMMAND = "command"
+const PERFORM_MARK = "mark"
+
+// Transitions without recorded deltas are typed in at most
+// PERFORM_TYPING_STEPS steps over the last PERFORM_TYPING_WINDOW before
+// the snapshot.
+const PERFORM_TYPING_STEPS = 40
+const PERFORM_TYPING_WINDOW = 5 * time.Second
+const PERFORM_MAX_IDLE = 10 * time.Second
+
+// typingChunks splits the ops from one text to another into steps of
+// whole lines, at most max of them.
+func typingChunks(from string, to string, max int) [][]DeltaOp {
+	ops := []DeltaOp{}
+	for _, op := range deltaOps(from, to) {
+		if op.Insert == "" {
+			ops = append(ops, op)
+			continue
+		}
+		pos := op.Pos
+		for _, line := range strings.SplitAfter(op.Insert, "\n") {
+			if line == "" {
+				continue
+			}
+			ops = append(ops, DeltaOp{Pos: pos, Insert: line})
+			pos += utf8.RuneCountInString(line)
+		}
+	}
+
+	chunks := [][]DeltaOp{}
+	size := (len(ops) + max - 1) / max
+	for len(ops) > 0 {
+		n := size
+		if n > len(ops) {
+			n = len(ops)
+		}
+		chunks = append(chunks, ops[:n])
+		ops = ops[n:]
+	}
+	return chunks
+}
+
+func textFiles(r *git.Repository, s Snapshot) (map[string]string, error) {
+	files := map[string]string{}
+	treeFiles, err := snapshotTreeFiles(r, s)
+	if err != nil {
+		return nil, err
+	}
+	for name, f := range treeFiles {
+		if name == CUI_LOG || f.Size > DELTA_MAX_FILE_SIZE {
+			continue
+		}
+		if binary, err := f.IsBinary(); err != nil || binary {
+			continue
+		}
+		contents, err := f.Contents()
+		if err != nil {
+			return nil, err
+		}
+		if utf8.ValidString(contents) {
+			files[name] = contents
+		}
+	}
+	return files, nil
+}
+
+// synthesizeDeltas makes up the typing between two snapshots that were
+// recorded without deltas. Files are typed one after the other, removed
+// files are left to the snapshot step.
+func synthesizeDeltas(from map[string]string, to map[string]string, id int, start int64, end int64) []Delta {
+	paths := []string{}
+	for path, text := range to {
+		if from[path] != text {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	deltas := []Delta{}
+	for _, path := range paths {
+		for _, ops := range typingChunks(from[path], to[path], PERFORM_TYPING_STEPS) {
+			deltas = append(deltas, Delta{Snapshot: id, File: path, Ops: ops})
+		}
+	}
+	if len(deltas) > PERFORM_TYPING_STEPS {
+		merged := []Delta{}
+		size := (len(deltas) + PERFORM_TYPING_STEPS - 1) / PERFORM_TYPING_STEPS
+		for i, delta := range deltas {
+			last := len(merged) - 1
+			if i%size != 0 && merged[last].File == delta.File {
+				merged[last].Ops = append(merged[last].Ops, delta.Ops...)
+			} else {
+				merged = append(merged, delta)
+			}
+		}
+		deltas = merged
+	}
+	for i := range deltas {
+		deltas[i].Time = start + (end-start)*int64(i+1)/int64(len(deltas)+1)
+	}
+	return deltas
+}
+
+// performTimeline orders everything a session did. A marker is moved
+// before the first delta recorded after its snapshot, so that the work
+// tree is exactly that snapshot when the performance stops there.
+func performTimeline(r *git.Repository, snapshots Snapshots, events Events, deltas []Delta) ([]PerformStep, error) {
+	steps := []PerformStep{}
+	for i, s := range snapshots {
+		steps = append(steps, PerformStep{Time: s.Time, Kind: PERFORM_SNAPSHOT, Snapshot: i})
+	}
+
+	recorded := map[int][]Delta{}
+	for _, d := range deltas {
+		if !d.Fix {
+			recorded[d.Snapshot] = append(recorded[d.Snapshot], d)
+		}
+	}
+
+	lastMark := map[int]int64{}
+	for _, e := range events {
+		switch e.Type {
+		case "command":
+			steps = append(steps, PerformStep{Time: e.Time - e.Duration, Kind: PERFORM_COMMAND, Snapshot: e.Snapshot, Event: e})
+		case "mark":
+			if e.Snapshot < 0 || e.Snapshot >= len(snapshots) {
+				continue
+			}
+			t := e.Time
+			if d := recorded[e.Snapshot]; len(d) > 0 && d[0].Time < t {
+				t = d[0].Time - 1
+			}
+			if e.Snapshot+1 < len(snapshots) && snapshots[e.Snapshot+1].Time <= t {
+				t = snapshots[e.Snapshot+1].Time - 1
+			}
+			if t < snapshots[e.Snapshot].Time {
+				t = snapshots[e.Snapshot].Time
+			}
+			steps = append(steps, PerformStep{Time: t, Kind: PERFORM_MARK, Snapshot: e.Snapshot, Event: e})
+			lastMark[e.Snapshot] = t
+		}
+	}
+
+	var from map[string]string
+	for i := 0; i+1 < len(snapshots); i++ {
+		if d := recorded[i]; len(d) > 0 {
+			for _, delta := range d {
+				steps = append(steps, PerformStep{Time: delta.Time, Kind: PERFORM_DELTA, Snapshot: i, Delta: delta})
+			}
+			from = nil
+			continue
+		}
+
+		var err error
+		if from == nil {
+			if from, err = textFiles(r, snapshots[i]); err != nil {
+				return nil, err
+			}
+		}
+		to, err := textFiles(r, snapshots[i+1])
+		if err != nil {
+			return nil, err
+		}
+		end := snapshots[i+1].Time
+		start := end - PERFORM_TYPING_WINDOW.Nanoseconds()
+		if start < snapshots[i].Time {
+			start = snapshots[i].Time
+		}
+		if t, ok := lastMark[i]; ok && start < t {
+			start = t
+		}
+		for _, delta := range synthesizeDeltas(from, to, i, start, end) {
+			steps = append(steps, PerformStep{Time: delta.Time, Kind: PERFORM_DELTA, Snapshot: i, Delta: delta})
+		}
+		from = to
+	}
+
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Time < steps[j].Time })
+	return steps, nil
+}
+
+func (p *Performer) writeFile(path string, contents []byte, mode os.FileMode) error {
+	fullPath := filepath.Join(p.dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fullPath, contents, mode.Perm()); err != nil {
+		return err
+	}
+	p.modes[path] = mode
+	return os.Chmod(fullPath, mode.Perm())
+}
+
+// writeSnapshot makes dir exactly snapshot id, leaving alone the files
+// that already are.
+func (p *Performer) writeSnapshot(id int) error {
+	treeFiles, err := snapshotTreeFiles(p.r, p.snapshots[id])
+	if err != nil {
+		return err
+	}
+	for path := range p.modes {
+		if _, ok := treeFiles[path]; !ok {
+			if err := os.Remove(filepath.Join(p.dir, filepath.FromSlash(path))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(p.modes, path)
+			delete(p.files, path)
+		}
+	}
+	for path, f := range treeFiles {
+		if path == CUI_LOG {
+			continue
+		}
+		contents, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			mode = 0644
+		}
+		if text, ok := p.files[path]; ok && text == contents && p.modes[path] == mode {
+			continue
+		}
+		if err := p.writeFile(path, []byte(contents), mode); err != nil {
+			return err
+		}
+		p.files[path] = contents
+	}
+	return nil
+}
+
+func (p *Performer) applyDelta(delta Delta) error {
+	text, ok := replayDelta(p.files[delta.File], delta)
+	if !ok {
+		return nil
+	}
+	mode, ok := p.modes[delta.File]
+	if !ok {
+		mode = 0644
+	}
+	if err := p.writeFile(delta.File, []byte(text), mode); err != nil {
+		return err
+	}
+	p.files[delta.File] = text
+	return nil
+}
+
+// verify lists the files of snapshot id that are missing from dir or not
+// byte-identical to it, and the files of dir that are not in the snapshot.
+func (p *Performer) verify(id int) ([]string, []string, error) {
+	treeFiles, err := snapshotTreeFiles(p.r, p.snapshots[id])
+	if err != nil {
+		return nil, nil, err
+	}
+	differ := []string{}
+	for path, f := range treeFiles {
+		if path == CUI_LOG {
+			continue
+		}
+		contents, err := f.Contents()
+		if err != nil {
+			return nil, nil, err
+		}
+		disk, err := ioutil.ReadFile(filepath.Join(p.dir, filepath.FromSlash(path)))
+		if err != nil || !bytes.Equal(disk, []byte(contents)) {
+			differ = append(differ, path)
+		}
+	}
+	sort.Strings(differ)
+
+	extra := []string{}
+	err = filepath.Walk(p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(p.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := treeFiles[rel]; !ok && rel != CUI_LOG {
+			extra = append(extra, rel)
+		}
+		return nil
+	})
+	sort.Strings(extra)
+	return differ, extra, err
+}
+
+// check makes sure dir is exactly snapshot id. A file that differs, is
+// missing or is not in the snapshot fails the performance, unless repair
+// is set: then the snapshot is written back over dir.
+func (p *Performer) check(label string, id int) error {
+	differ, extra, err := p.verify(id)
+	if err != nil {
+		return err
+	}
+	if len(differ) == 0 && len(extra) == 0 {
+		writeCommandOut(fmt.Sprintf("%s: identical to snapshot %d.\n", label, id), p.projectPath, false)
+		return nil
+	}
+	problems := []string{}
+	if len(differ) > 0 {
+		problems = append(problems, fmt.Sprintf("%s differ from snapshot %d", strings.Join(differ, ", "), id))
+	}
+	if len(extra) > 0 {
+		problems = append(problems, fmt.Sprintf("%s not in snapshot %d", strings.Join(extra, ", "), id))
+	}
+	message := label + ": " + strings.Join(problems, ", ")
+	if !p.repair {
+		return errors.New(message + ", --repair writes the snapshot back.")
+	}
+	writeCommandOut(message+", restored.\n", p.projectPath, false)
+	for _, path := range differ {
+		delete(p.files, path)
+	}
+	for _, path := range extra {
+		if err := os.Remove(filepath.Join(p.dir, filepath.FromSlash(path))); err != nil {
+			return err
+		}
+		delete(p.files, path)
+		delete(p.modes, path)
+	}
+	return p.writeSnapshot(id)
+}
+
+// play does every step at its time in the session, with the pauses cut to
+// maxIdle and sped up by speed. The times are kept from the start of the
+// performance, so that the time a step takes is not added to the next
+// one. Keys are the keys pressed, nil without a terminal. It returns false
+// if the performance was stopped with q or Ctrl-C.
+func (p *Performer) play(steps []PerformStep, speed float64, maxIdle time.Duration, keys <-chan int) (bool, error) {
+	start := time.Now()
+	elapsed := time.Duration(0)
+	last := steps[0].Time
+	for _, step := range steps {
+		gap := time.Duration(step.Time - last)
+		if gap > maxIdle {
+			gap = maxIdle
+		}
+		last = step.Time
+		elapsed += gap
+		if !waitForStep(start.Add(time.Duration(float64(elapsed)/speed)), keys) {
+			return false, nil
+		}
+
+		switch step.Kind {
+		case PERFORM_SNAPSHOT:
+			if err := p.writeSnapshot(step.Snapshot); err != nil {
+				return false, err
+			}
+		case PERFORM_DELTA:
+			if err := p.applyDelta(step.Delta); err != nil {
+				writeCommandOut(step.Delta.File+": "+err.Error()+"\n", p.projectPath, false)
+			}
+		case PERFORM_COMMAND:
+			writeCommandOut("$ "+step.Event.Command+"\n", p.projectPath, false)
+			if p.run {
+				p.runCommand(step.Event.Command)
+			}
+		case PERFORM_MARK:
+			if err := p.check("marker \""+step.Event.Label+"\"", step.Snapshot); err != nil {
+				return false, err
+			}
+			if keys != nil {
+				writeCommandOut("press enter to continue, q to stop.\n", p.projectPath, false)
+				paused := time.Now()
+				if !waitForEnter(keys) {
+					return false, nil
+				}
+				start = start.Add(time.Since(paused))
+			}
+		}
+	}
+	return true, p.check("end", len(p.snapshots)-1)
+}
+
+// waitForStep waits until t. It returns false if q or Ctrl-C is pressed
+// first.
+func waitForStep(t time.Time, keys <-chan int) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case key := <-keys:
+			if key == 'q' {
+				return false
+			}
+		case <-interrupted():
+			return false
+		}
+	}
+}
+
+// waitForEnter waits for enter, and returns false on q or Ctrl-C.
+func waitForEnter(keys <-chan int) bool {
+	for {
+		select {
+		case key := <-keys:
+			switch key {
+			case '\r', '\n':
+				return true
+			case 'q':
+				return false
+			}
+		case <-interrupted():
+			return false
+		}
+	}
+}
+
+func (p *Performer) runCommand(command string) {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = p.dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		writeCommandOut(err.Error()+"\n", p.projectPath, false)
+	}
+}
+
+// live perform <session> <dir> [--speed n] [--max-idle seconds] [--run] [--repair]
+func livePerform(args []string, projectPath string) {
+	args, run := hasFlag(args, "--run")
+	args, repair := hasFlag(args, "--repair")
+	args, speedValue, _ := flagValue(args, "--speed")
+	args, idleValue, _ := flagValue(args, "--max-idle")
+	if len(args) != 2 {
+		writeCommandOut("usage: live perform <session> <dir> [--speed n] [--max-idle seconds] [--run] [--repair]\n", projectPath, false)
+		return
+	}
+	speed := 1.0
+	if speedValue != "" {
+		s, err := strconv.ParseFloat(speedValue, 64)
+		if err != nil || s <= 0 {
+			writeCommandOut("speed is invalid.\n", projectPath, false)
+			return
+		}
+		speed = s
+	}
+	maxIdle := PERFORM_MAX_IDLE
+	if idleValue != "" {
+		s, err := strconv.ParseFloat(idleValue, 64)
+		if err != nil || s < 0 {
+			writeCommandOut("max idle is invalid.\n", projectPath, false)
+			return
+		}
+		maxIdle = time.Duration(s * float64(time.Second))
+	}
+
+	dir, err := filepath.Abs(args[1])
+	if err == nil {
+		if _, statErr := os.Stat(dir); statErr == nil {
+			err = errors.New(dir + " already exists.")
+		}
+	}
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	r, root, cleanup, err := openSessionPath(args[0])
+	defer cleanup()
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	events, err := readEvents(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	deltas, err := loadDeltas(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if len(snapshots) == 0 {
+		writeCommandOut("no snapshots.\n", projectPath, false)
+		return
+	}
+	steps, err := performTimeline(r, snapshots, events, deltas)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	p := &Performer{
+		r:           r,
+		dir:         dir,
+		snapshots:   snapshots,
+		files:       map[string]string{},
+		modes:       map[string]os.FileMode{},
+		run:         run,
+		repair:      repair,
+		projectPath: projectPath,
+	}
+
+	var keys <-chan int
+	if restore, err := rawTerminal(); err == nil {
+		stop := make(chan struct{})
+		keys = readKeys(stop)
+		defer func() {
+			close(stop)
+			for range keys {
+			}
+			restore()
+		}()
+	}
+
+	writeCommandOut(fmt.Sprintf("performing %d snapshots into %s at %gx.\n", len(snapshots), dir, speed), projectPath, false)
+	finished, err := p.play(steps, speed, maxIdle, keys)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if !finished {
+		writeCommandOut("stopped.\n", projectPath, false)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// newTestPerformer loads the session in dir and returns a performer for a
+// new directory, with the steps to play.
+func newTestPerformer(t *testing.T, dir string) (*Performer, []PerformStep) {
+	t.Helper()
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := loadSnapshotIndex(r, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := readEvents(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deltas, err := loadDeltas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := performTimeline(r, snapshots, events, deltas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	performDir, err := ioutil.TempDir("", "live-perform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(performDir) })
+	return &Performer{r: r, dir: performDir, snapshots: snapshots, files: map[string]string{}, modes: map[string]os.FileMode{}}, steps
+}
+
+func TestPerformIsIdenticalAtMarkers(t *testing.T) {
+	dir, store := newDeltaTestProject(t)
+	writeProjectFile(t, dir, "main.go", "package main\n", 0)
+	if _, err := store.Put(time.Now().UnixNano(), ""); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDeltaRecorder(store, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeProjectFile(t, dir, "main.go", "package main\n\nfunc main() {\n", 1)
+	d.record(dir)
+	writeProjectFile(t, dir, "main.go", "package main\n\nfunc main() {\n}\n", 2)
+	d.record(dir)
+	snapshot, err := store.Put(time.Now().UnixNano(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyDeltas(store, snapshot.ID, dir); err != nil {
+		t.Fatal(err)
+	}
+	writeEvent(Event{Time: time.Now().UnixNano(), Snapshot: snapshot.ID, Type: "mark", Label: "main"}, dir, true)
+	writeProjectFile(t, dir, "notes.txt", "done\n", 3)
+	if _, err := store.Put(time.Now().UnixNano(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	p, steps := newTestPerformer(t, dir)
+	finished, err := p.play(steps, 1, 0, nil)
+	if err != nil || !finished {
+		t.Fatalf("play finished %v with %v", finished, err)
+	}
+
+	extra := filepath.Join(p.dir, "build.out")
+	if err := ioutil.WriteFile(extra, []byte("built\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p.dir, "notes.txt"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = p.check("end", 2)
+	if err == nil || !strings.Contains(err.Error(), "build.out") || !strings.Contains(err.Error(), "notes.txt") {
+		t.Fatalf("check of a changed directory gave %v", err)
+	}
+
+	p.repair = true
+	if err := p.check("end", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(extra); !os.IsNotExist(err) {
+		t.Errorf("repair left build.out")
+	}
+	if differ, extras, err := p.verify(2); err != nil || len(differ) != 0 || len(extras) != 0 {
+		t.Errorf("after the repair %v differ and %v are extra (%v)", differ, extras, err)
+	}
+}
+
+func TestPerformKeepsPace(t *testing.T) {
+	dir, store := newDeltaTestProject(t)
+	writeProjectFile(t, dir, "main.go", "package main\n", 0)
+	if _, err := store.Put(time.Now().UnixNano(), ""); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestPerformer(t, dir)
+
+	// 3 seconds of typing, a key every 100ms
+	start := time.Now().UnixNano()
+	steps := []PerformStep{}
+	for i := 0; i < 30; i++ {
+		delta := Delta{Time: start + int64(i)*int64(100*time.Millisecond), File: "main.go", Ops: []DeltaOp{{Pos: i, Insert: "x"}}}
+		steps = append(steps, PerformStep{Time: delta.Time, Kind: PERFORM_DELTA, Delta: delta})
+	}
+	keys := make(chan int)
+	began := time.Now()
+	finished, _ := p.play(steps, 10, PERFORM_MAX_IDLE, keys)
+	if !finished {
+		t.Fatal("play was stopped")
+	}
+	if took := time.Since(began); took > time.Second {
+		t.Errorf("3s at 10x took %v", took)
+	}
+}
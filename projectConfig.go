@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// BuildPattern marks the shell commands whose results are tracked on the
+// timeline. Pattern is a regular expression matched against the command
+// line. Format "go-test" parses the failing test names from the output.
+type BuildPattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Format  string `json:"format,omitempty"`
+}
+
+// ProjectConfig is read from .live.json in the project root.
+type ProjectConfig struct {
+	Builds  []BuildPattern `json:"builds"`
+	Hooks   Hooks          `json:"hooks"`
+	Deltas  bool           `json:"deltas"`
+	Export  ExportConfig   `json:"export"`
+	Publish PublishConfig  `json:"publish"`
+	Store   string         `json:"store,omitempty"`
+	Idle    IdleConfig     `json:"idle"`
+}
+
+// ExportConfig holds the defaults of "live export". A diff longer than
+// MaxDiffLines is shown as a list of changed files in a tutorial.
+type ExportConfig struct {
+	MaxDiffLines int `json:"max_diff_lines"`
+}
+
+const PROJECT_CONFIG = ".live.json"
+
+var defaultBuildPatterns = []BuildPattern{
+	{Name: "go test", Pattern: `^go test\b`, Format: "go-test"},
+	{Name: "go build", Pattern: `^go (build|vet|run)\b`},
+	{Name: "make", Pattern: `^make\b`},
+	{Name: "npm", Pattern: `^npm (test|run build)\b`},
+	{Name: "cargo", Pattern: `^cargo (build|test)\b`},
+}
+
+func loadProjectConfig(projectPath string) (ProjectConfig, error) {
+	config := ProjectConfig{}
+	data, err := ioutil.ReadFile(filepath.Join(projectPath, PROJECT_CONFIG))
+	if err != nil && !os.IsNotExist(err) {
+		return config, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, err
+		}
+	}
+
+	if config.Builds == nil {
+		config.Builds = defaultBuildPatterns
+	}
+	return config, nil
+}
+
+// matchBuild returns the build pattern the command line matches, or nil.
+func (config ProjectConfig) matchBuild(command string) *BuildPattern {
+	for i, b := range config.Builds {
+		matched, err := regexp.MatchString(b.Pattern, command)
+		if err != nil {
+			continue
+		}
+		if matched {
+			return &config.Builds[i]
+		}
+	}
+	return nil
+}
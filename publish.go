@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage"
+)
+
+// PublishConfig is the "publish" section of .live.json. It only changes
+// what "live upload" sends, the local history is never rewritten.
+type PublishConfig struct {
+	Include    []string `json:"include"`
+	Exclude    []string `json:"exclude"`
+	Redact     []string `json:"redact"`
+	FromMarker string   `json:"from_marker"`
+}
+
+// PublishPlan is the session as it will be published. Excluded maps every
+// file left out to the reason. LogOffset is the length of the terminal log
+// at the from_marker marker, which is cut from the log of every snapshot.
+type PublishPlan struct {
+	Snapshots Snapshots
+	First     int
+	LogOffset int64
+	Files     []string
+	Excluded  map[string]string
+	Events    Events
+	Deltas    []Delta
+}
+
+func (config PublishConfig) filtered() bool {
+	return len(config.Include) > 0 || len(config.Exclude) > 0 || len(config.Redact) > 0 || config.FromMarker != ""
+}
+
+// globRegexp turns a glob into a regular expression. "**" matches any
+// number of directories, and a glob without "/" matches the file name in
+// any directory.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	expr := ""
+	if !strings.Contains(glob, "/") {
+		expr = "(.*/)?"
+	}
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr += ".*"
+			i++
+		case glob[i] == '*':
+			expr += "[^/]*"
+		case glob[i] == '?':
+			expr += "[^/]"
+		default:
+			expr += regexp.QuoteMeta(glob[i : i+1])
+		}
+	}
+	return regexp.Compile("^" + expr + "$")
+}
+
+func matchGlobs(file string, globs []*regexp.Regexp) bool {
+	for _, glob := range globs {
+		if glob.MatchString(file) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileGlobs(globs []string) ([]*regexp.Regexp, error) {
+	compiled := []*regexp.Regexp{}
+	for _, glob := range globs {
+		re, err := globRegexp(glob)
+		if err != nil {
+			return nil, errors.New("publish glob " + glob + ": " + err.Error())
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// planPublish applies the publish filter to the session. Files are
+// excluded by path, or for their whole history if any published version
+// matched a redaction rule, including the versions in between snapshots
+// that replaying the deltas goes through. Events that mention a redacted
+// string or an excluded file are left out too.
+func planPublish(r *git.Repository, snapshots Snapshots, events Events, deltas []Delta, config PublishConfig) (PublishPlan, error) {
+	plan := PublishPlan{Excluded: map[string]string{}, Events: Events{}, Deltas: []Delta{}}
+
+	include, err := compileGlobs(config.Include)
+	if err != nil {
+		return plan, err
+	}
+	exclude, err := compileGlobs(config.Exclude)
+	if err != nil {
+		return plan, err
+	}
+	redact := []*regexp.Regexp{}
+	for _, rule := range config.Redact {
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return plan, errors.New("publish redaction rule " + rule + ": " + err.Error())
+		}
+		redact = append(redact, re)
+	}
+
+	markerTime := int64(0)
+	if config.FromMarker != "" {
+		found := false
+		for _, e := range events {
+			if e.Type == "mark" && e.Label == config.FromMarker && e.Snapshot >= 0 {
+				plan.First = e.Snapshot
+				plan.LogOffset = e.LogOffset
+				markerTime = e.Time
+				found = true
+				break
+			}
+		}
+		if !found {
+			return plan, errors.New("marker \"" + config.FromMarker + "\" doesn't exist")
+		}
+		// markers made before the terminal log length was recorded cut the
+		// log as it was at the first snapshot kept
+		if plan.LogOffset == 0 {
+			terminal, err := snapshotFile(r, snapshots[plan.First], CUI_LOG)
+			if err != nil {
+				return plan, err
+			}
+			plan.LogOffset = int64(len(terminal))
+		}
+	}
+	plan.Snapshots = snapshots[plan.First:]
+
+	files := map[string]bool{}
+	redactedBy := map[plumbing.Hash]string{}
+	for _, s := range plan.Snapshots {
+		treeFiles, err := snapshotTreeFiles(r, s)
+		if err != nil {
+			return plan, err
+		}
+		for name, f := range treeFiles {
+			if _, ok := plan.Excluded[name]; ok {
+				continue
+			}
+			if matchGlobs(name, exclude) {
+				plan.Excluded[name] = "excluded"
+				continue
+			}
+			if len(include) > 0 && name != CUI_LOG && !matchGlobs(name, include) {
+				plan.Excluded[name] = "not included"
+				continue
+			}
+			rule, ok := redactedBy[f.Hash]
+			if !ok {
+				contents, err := publishedContents(f, plan)
+				if err != nil {
+					return plan, err
+				}
+				rule = redactionRule(contents, redact, config.Redact)
+				redactedBy[f.Hash] = rule
+			}
+			if rule != "" {
+				plan.Excluded[name] = "redacted by " + rule
+				continue
+			}
+			files[name] = true
+		}
+	}
+	for name := range plan.Excluded {
+		delete(files, name)
+	}
+	if len(redact) > 0 {
+		if err := redactDeltas(r, plan, files, deltas, redact, config.Redact); err != nil {
+			return plan, err
+		}
+		for name := range plan.Excluded {
+			delete(files, name)
+		}
+	}
+	for name := range files {
+		plan.Files = append(plan.Files, name)
+	}
+	sort.Strings(plan.Files)
+
+	published := func(file string) bool {
+		_, excluded := plan.Excluded[file]
+		return !excluded
+	}
+	for _, e := range events {
+		if e.Snapshot < plan.First || e.Time < markerTime {
+			continue
+		}
+		if e.Editor != nil && !published(e.Editor.File) {
+			continue
+		}
+		if matchRedaction(e.Command, redact) || matchRedaction(e.Label, redact) {
+			continue
+		}
+		if b := e.Build; b != nil && (matchRedaction(b.Summary, redact) || matchRedaction(strings.Join(b.Failed, "\n"), redact)) {
+			continue
+		}
+		e.Snapshot -= plan.First
+		plan.Events = append(plan.Events, e)
+	}
+	for _, d := range deltas {
+		if d.Snapshot >= plan.First && published(d.File) {
+			d.Snapshot -= plan.First
+			plan.Deltas = append(plan.Deltas, d)
+		}
+	}
+	return plan, nil
+}
+
+// redactionRule returns the first rule contents match, or "".
+func redactionRule(contents string, redact []*regexp.Regexp, rules []string) string {
+	for i, re := range redact {
+		if re.MatchString(contents) {
+			return rules[i]
+		}
+	}
+	return ""
+}
+
+// publishedContents is f as it will be published: the terminal log starts
+// at the from_marker marker.
+func publishedContents(f *object.File, plan PublishPlan) (string, error) {
+	contents, err := f.Contents()
+	if err != nil {
+		return "", err
+	}
+	if f.Name == CUI_LOG {
+		contents = trimTerminalLog(contents, plan.LogOffset)
+	}
+	return contents, nil
+}
+
+func trimTerminalLog(contents string, offset int64) string {
+	if int64(len(contents)) <= offset {
+		return ""
+	}
+	return contents[offset:]
+}
+
+// redactDeltas replays the deltas of the published files from each kept
+// snapshot and excludes every file that, at some point in between two
+// snapshots, matched a redaction rule. A secret typed and deleted again
+// never reaches a snapshot, but it is in the deltas.
+func redactDeltas(r *git.Repository, plan PublishPlan, files map[string]bool, deltas []Delta, redact []*regexp.Regexp, rules []string) error {
+	texts := map[string]string{}
+	snapshot := -1
+	for _, d := range deltas {
+		if d.Snapshot < plan.First || d.Snapshot-plan.First >= len(plan.Snapshots) || !files[d.File] {
+			continue
+		}
+		if _, excluded := plan.Excluded[d.File]; excluded {
+			continue
+		}
+		if d.Snapshot != snapshot {
+			texts = map[string]string{}
+			snapshot = d.Snapshot
+		}
+		text, ok := texts[d.File]
+		if !ok {
+			var err error
+			if text, err = snapshotFile(r, plan.Snapshots[d.Snapshot-plan.First], d.File); err != nil {
+				return err
+			}
+		}
+		text, _ = replayDelta(text, d)
+		texts[d.File] = text
+
+		inserts := []string{}
+		for _, op := range d.Ops {
+			inserts = append(inserts, op.Insert)
+		}
+		if rule := redactionRule(text+"\n"+strings.Join(inserts, "\n"), redact, rules); rule != "" {
+			plan.Excluded[d.File] = "redacted by " + rule + " in an edit"
+		}
+	}
+	return nil
+}
+
+func matchRedaction(text string, redact []*regexp.Regexp) bool {
+	for _, re := range redact {
+		if text != "" && re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishManifest lists what "live upload" will send.
+func publishManifest(plan PublishPlan, config PublishConfig) string {
+	out := fmt.Sprintf("snapshots: %d", len(plan.Snapshots))
+	if plan.First > 0 {
+		out += fmt.Sprintf(" (%d before marker \"%s\" are left out)", plan.First, config.FromMarker)
+	}
+	out += "\n"
+	out += "events: " + strconv.Itoa(len(plan.Events)) + "\n"
+	out += "files:\n"
+	for _, file := range plan.Files {
+		out += "  " + file + "\n"
+	}
+	if len(plan.Excluded) > 0 {
+		excluded := []string{}
+		for file := range plan.Excluded {
+			excluded = append(excluded, file)
+		}
+		sort.Strings(excluded)
+		out += "left out:\n"
+		for _, file := range excluded {
+			out += "  " + file + " (" + plan.Excluded[file] + ")\n"
+		}
+	}
+	return out
+}
+
+type treeFile struct {
+	hash plumbing.Hash
+	mode filemode.FileMode
+}
+
+// writeTree stores the tree of files and returns its hash.
+func writeTree(s storage.Storer, files map[string]treeFile) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	subdirs := map[string]map[string]treeFile{}
+	for name, f := range files {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) == 1 {
+			tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: f.mode, Hash: f.hash})
+			continue
+		}
+		if subdirs[parts[0]] == nil {
+			subdirs[parts[0]] = map[string]treeFile{}
+		}
+		subdirs[parts[0]][parts[1]] = f
+	}
+	for name, subfiles := range subdirs {
+		hash, err := writeTree(s, subfiles)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash})
+	}
+
+	// git sorts directories as if their names ended with "/"
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool { return sortName(tree.Entries[i]) < sortName(tree.Entries[j]) })
+
+	obj := s.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// writeTerminalLog stores the terminal log f cut at the from_marker
+// marker.
+func writeTerminalLog(s storage.Storer, f *object.File, plan PublishPlan) (plumbing.Hash, error) {
+	contents, err := publishedContents(f, plan)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	writer, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := writer.Write([]byte(contents)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	writer.Close()
+	return s.SetEncodedObject(obj)
+}
+
+// writePublishRepository writes the planned snapshots, with the same
+// messages and times, to a new repository in dir, along with its live
+// data.
+func writePublishRepository(r *git.Repository, plan PublishPlan, dir string) error {
+	published, err := git.PlainInit(dir, false)
+	if err != nil {
+		return err
+	}
+
+	copied := map[plumbing.Hash]bool{}
+	parent := plumbing.ZeroHash
+	for _, s := range plan.Snapshots {
+		c, err := snapshotCommit(r, s)
+		if err != nil {
+			return err
+		}
+		treeFiles, err := snapshotTreeFiles(r, s)
+		if err != nil {
+			return err
+		}
+		files := map[string]treeFile{}
+		for name, f := range treeFiles {
+			if _, excluded := plan.Excluded[name]; excluded {
+				continue
+			}
+			if name == CUI_LOG && plan.LogOffset > 0 {
+				hash, err := writeTerminalLog(published.Storer, f, plan)
+				if err != nil {
+					return err
+				}
+				files[name] = treeFile{hash: hash, mode: f.Mode}
+				continue
+			}
+			if !copied[f.Hash] {
+				obj, err := r.Storer.EncodedObject(plumbing.BlobObject, f.Hash)
+				if err != nil {
+					return err
+				}
+				if _, err := published.Storer.SetEncodedObject(obj); err != nil {
+					return err
+				}
+				copied[f.Hash] = true
+			}
+			files[name] = treeFile{hash: f.Hash, mode: f.Mode}
+		}
+		treeHash, err := writeTree(published.Storer, files)
+		if err != nil {
+			return err
+		}
+
+		commit := &object.Commit{Author: c.Author, Committer: c.Committer, Message: c.Message, TreeHash: treeHash}
+		if !parent.IsZero() {
+			commit.ParentHashes = []plumbing.Hash{parent}
+		}
+		obj := published.Storer.NewEncodedObject()
+		if err := commit.Encode(obj); err != nil {
+			return err
+		}
+		parent, err = published.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return err
+		}
+	}
+	head := plumbing.NewHashReference(plumbing.Master, parent)
+	if err := published.Storer.SetReference(head); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, LIVE_DATA_DIR), 0755); err != nil {
+		return err
+	}
+	if _, err := loadSnapshotIndex(published, dir); err != nil {
+		return err
+	}
+
+	eventFile, err := os.Create(liveDataPath(dir, EVENT_LOG))
+	if err != nil {
+		return err
+	}
+	defer eventFile.Close()
+	encoder := json.NewEncoder(eventFile)
+	for _, e := range plan.Events {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	deltaFile, err := os.Create(liveDataPath(dir, DELTA_LOG))
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+	encoder = json.NewEncoder(deltaFile)
+	for _, d := range plan.Deltas {
+		if err := encoder.Encode(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preparePublish shows what "live upload" will send and asks to go on. It
+// returns the directory whose .git should be uploaded, which is a filtered
+// copy in a temporary directory when the project has a publish filter.
+func preparePublish(projectPath string) (string, bool, error) {
+	r, err := git.PlainOpen(projectPath)
+	if err != nil {
+		return "", false, err
+	}
+	config, err := loadProjectConfig(projectPath)
+	if err != nil {
+		return "", false, errors.New(PROJECT_CONFIG + ": " + err.Error())
+	}
+	snapshots, err := loadSnapshotIndex(r, projectPath)
+	if err != nil {
+		return "", false, err
+	}
+	events, err := readEvents(projectPath)
+	if err != nil {
+		return "", false, err
+	}
+	deltas, err := loadDeltas(projectPath)
+	if err != nil {
+		return "", false, err
+	}
+
+	plan, err := planPublish(r, snapshots, events, deltas, config.Publish)
+	if err != nil {
+		return "", false, err
+	}
+	writeCommandOut(publishManifest(plan, config.Publish), projectPath, false)
+	if !confirm("upload " + filepath.Base(projectPath) + "?") {
+		return "", false, nil
+	}
+	if !config.Publish.filtered() {
+		return projectPath, true, nil
+	}
+
+	dir, err := ioutil.TempDir("", "live-publish")
+	if err != nil {
+		return "", false, err
+	}
+	if err := writePublishRepository(r, plan, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", false, err
+	}
+	return dir, true, nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/utils/diff"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+const REPLAY_MAX_GAP = 2 * time.Second
+const REPLAY_MIN_GAP = 50 * time.Millisecond
+
+const (
+	KEY_NONE  = 0
+	KEY_RIGHT = 1000 + iota
+	KEY_LEFT
+)
+
+// KEY_WAIT is how long readKey waits for a key, as the raw terminal does.
+const KEY_WAIT = 100 * time.Millisecond
+
+// rawTerminal puts the terminal into non-canonical mode where a read
+// returns after at most 100ms. The returned function restores it.
+func rawTerminal() (func(), error) {
+	save := exec.Command("stty", "-g")
+	save.Stdin = os.Stdin
+	saved, err := save.Output()
+	if err != nil {
+		return nil, err
+	}
+	raw := exec.Command("stty", "-icanon", "-echo", "min", "0", "time", "1")
+	raw.Stdin = os.Stdin
+	if err := raw.Run(); err != nil {
+		return nil, err
+	}
+	return func() {
+		restore := exec.Command("stty", strings.TrimSpace(string(saved)))
+		restore.Stdin = os.Stdin
+		restore.Run()
+	}, nil
+}
+
+func terminalSize() (int, int) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err == nil {
+		fields := strings.Fields(string(out))
+		if len(fields) == 2 {
+			rows, err1 := strconv.Atoi(fields[0])
+			cols, err2 := strconv.Atoi(fields[1])
+			if err1 == nil && err2 == nil && rows > 10 && cols > 20 {
+				return rows, cols
+			}
+		}
+	}
+	return 24, 80
+}
+
+// readKey returns the key pressed, or KEY_NONE if there is none within
+// 100ms. It reads the same input as the prompt.
+func readKey() int {
+	b, ok := readByte(KEY_WAIT)
+	if !ok {
+		return KEY_NONE
+	}
+	if b == 0x1b {
+		b1, ok1 := readByte(KEY_WAIT)
+		b2, ok2 := readByte(KEY_WAIT)
+		if ok1 && ok2 && b1 == '[' {
+			switch b2 {
+			case 'C':
+				return KEY_RIGHT
+			case 'D':
+				return KEY_LEFT
+			}
+		}
+		return KEY_NONE
+	}
+	return int(b)
+}
+
+// readKeys reads the keys pressed in a goroutine of its own until stop is
+// closed, so that waiting for a key never holds up a performance. The
+// channel is closed once the reader is done, at most 100ms after stop.
+func readKeys(stop <-chan struct{}) <-chan int {
+	keys := make(chan int)
+	go func() {
+		defer close(keys)
+		for {
+			key := readKey()
+			if key == KEY_NONE {
+				select {
+				case <-stop:
+					return
+				default:
+					continue
+				}
+			}
+			select {
+			case keys <- key:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return keys
+}
+
+func clipLine(line string, width int) string {
+	line = strings.Replace(line, "\t", "    ", -1)
+	runes := []rune(line)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return line
+}
+
+// ReplayFrame is what the replay shows for one snapshot: the file that
+// changed most with its changed lines, and the terminal log so far.
+type ReplayFrame struct {
+	Snapshot     Snapshot
+	File         string
+	Lines        []string
+	Changed      map[int]bool
+	Cursor       int
+	Terminal     []string
+	TerminalNew  int
+	MarkerLabel  string
+	RemovedLines int
+}
+
+func replayFrame(r *git.Repository, snapshots Snapshots, events Events, id int) (ReplayFrame, error) {
+	frame := ReplayFrame{Snapshot: snapshots[id], Changed: map[int]bool{}, Cursor: -1}
+
+	c, err := snapshotCommit(r, snapshots[id])
+	if err != nil {
+		return frame, err
+	}
+	fileStats, err := c.Stats()
+	if err != nil {
+		return frame, err
+	}
+	most := -1
+	for _, fs := range fileStats {
+		if fs.Name != CUI_LOG && fs.Addition+fs.Deletion > most {
+			most = fs.Addition + fs.Deletion
+			frame.File = fs.Name
+		}
+	}
+
+	for _, e := range events {
+		if e.Snapshot > id {
+			break
+		}
+		if e.Type == "mark" && e.Snapshot == id {
+			frame.MarkerLabel = e.Label
+		}
+		if e.Editor != nil && e.Editor.File != "" && (e.Type == "active" || e.Type == "cursor" || e.Type == "selection") {
+			if frame.File == "" || e.Type == "active" {
+				frame.File = e.Editor.File
+			}
+			if e.Editor.File == frame.File && e.Editor.Line > 0 {
+				frame.Cursor = e.Editor.Line - 1
+			}
+		}
+	}
+
+	prev := ""
+	if id > 0 {
+		prev, err = snapshotFile(r, snapshots[id-1], frame.File)
+		if err != nil {
+			return frame, err
+		}
+	}
+	if frame.File != "" {
+		cur, err := snapshotFile(r, snapshots[id], frame.File)
+		if err != nil {
+			return frame, err
+		}
+		line := 0
+		for _, d := range diff.Do(prev, cur) {
+			n := countLines(d.Text)
+			switch d.Type {
+			case diffmatchpatch.DiffEqual:
+				line += n
+			case diffmatchpatch.DiffInsert:
+				for i := 0; i < n; i++ {
+					frame.Changed[line+i] = true
+				}
+				line += n
+			case diffmatchpatch.DiffDelete:
+				frame.RemovedLines += n
+			}
+		}
+		frame.Lines = strings.Split(strings.TrimSuffix(cur, "\n"), "\n")
+	}
+
+	terminal, err := snapshotFile(r, snapshots[id], CUI_LOG)
+	if err != nil {
+		return frame, err
+	}
+	prevTerminal := ""
+	if id > 0 {
+		prevTerminal, err = snapshotFile(r, snapshots[id-1], CUI_LOG)
+		if err != nil {
+			return frame, err
+		}
+	}
+	frame.Terminal = strings.Split(strings.TrimSuffix(terminal, "\n"), "\n")
+	if strings.HasPrefix(terminal, prevTerminal) {
+		frame.TerminalNew = countLines(terminal[len(prevTerminal):])
+	}
+
+	return frame, nil
+}
+
+func renderReplayFrame(frame ReplayFrame, rows int, cols int, status string) string {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+
+	header := fmt.Sprintf("ID %d  %s  %s", frame.Snapshot.ID, formatSnapshotTime(frame.Snapshot.Time), frame.File)
+	if frame.RemovedLines > 0 {
+		header += fmt.Sprintf("  (-%d lines)", frame.RemovedLines)
+	}
+	if frame.Snapshot.Label != "" {
+		header += "  (" + frame.Snapshot.Label + ")"
+	}
+	if frame.MarkerLabel != "" {
+		header += "  [" + frame.MarkerLabel + "]"
+	}
+	b.WriteString("\x1b[7m" + clipLine(header, cols) + "\x1b[0m\n")
+
+	terminalRows := rows / 3
+	fileRows := rows - terminalRows - 3
+
+	first := 0
+	for i := range frame.Lines {
+		if frame.Changed[i] {
+			first = i
+			break
+		}
+	}
+	if frame.Cursor >= 0 && !frame.Changed[first] {
+		first = frame.Cursor
+	}
+	start := first - fileRows/3
+	if start > len(frame.Lines)-fileRows {
+		start = len(frame.Lines) - fileRows
+	}
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < start+fileRows; i++ {
+		if i >= len(frame.Lines) {
+			b.WriteString("\n")
+			continue
+		}
+		gutter := " "
+		color := ""
+		if frame.Changed[i] {
+			gutter = "+"
+			color = "\x1b[32m"
+		}
+		if i == frame.Cursor {
+			gutter = ">"
+			color = "\x1b[33m"
+		}
+		b.WriteString(fmt.Sprintf("%s%4d %s %s\x1b[0m\n", color, i+1, gutter, clipLine(frame.Lines[i], cols-8)))
+	}
+
+	b.WriteString("\x1b[7m" + clipLine(" terminal", cols) + "\x1b[0m\n")
+	start = len(frame.Terminal) - terminalRows
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < len(frame.Terminal); i++ {
+		if i >= len(frame.Terminal)-frame.TerminalNew {
+			b.WriteString("\x1b[1m" + clipLine(frame.Terminal[i], cols) + "\x1b[0m\n")
+		} else {
+			b.WriteString(clipLine(frame.Terminal[i], cols) + "\n")
+		}
+	}
+	for i := len(frame.Terminal) - start; i < terminalRows; i++ {
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\x1b[7m" + clipLine(status, cols) + "\x1b[0m")
+	return b.String()
+}
+
+func frameDelay(snapshots Snapshots, id int, speed float64) time.Duration {
+	if id+1 >= len(snapshots) {
+		return 0
+	}
+	d := time.Duration(float64(snapshots[id+1].Time-snapshots[id].Time) / speed)
+	if d > REPLAY_MAX_GAP {
+		d = REPLAY_MAX_GAP
+	}
+	if d < REPLAY_MIN_GAP {
+		d = REPLAY_MIN_GAP
+	}
+	return d
+}
+
+// readNumber reads digits until enter and shows them on the status line.
+func readNumber(prompt string, rows int) (int, bool) {
+	digits := ""
+	for {
+		fmt.Printf("\x1b[%d;1H\x1b[2K%s%s", rows, prompt, digits)
+		if isInterrupted() {
+			return 0, false
+		}
+		key := readKey()
+		switch {
+		case key >= '0' && key <= '9':
+			digits += string(rune(key))
+		case key == 127 && len(digits) > 0:
+			digits = digits[:len(digits)-1]
+		case key == '\n' || key == '\r':
+			id, err := strconv.Atoi(digits)
+			return id, err == nil
+		case key == 0x1b || key == 'q':
+			return 0, false
+		}
+	}
+}
+
+// live replay [@id] [--speed n]
+func liveReplay(args []string, projectPath string) {
+	args, speedValue, _ := flagValue(args, "--speed")
+	if len(args) > 1 {
+		writeCommandOut("usage: live replay [@id] [--speed n]\n", projectPath, false)
+		return
+	}
+	speed := 1.0
+	if speedValue != "" {
+		s, err := strconv.ParseFloat(speedValue, 64)
+		if err != nil || s <= 0 {
+			writeCommandOut("speed is invalid.\n", projectPath, false)
+			return
+		}
+		speed = s
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	events, err := readEvents(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	markers := sessionMarkers(events)
+
+	id := 0
+	if len(args) == 1 {
+		id, err = parseSnapshotID(args[0], snapshots)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+	}
+
+	restore, err := rawTerminal()
+	interactive := err == nil
+	if interactive {
+		defer restore()
+	}
+	rows, cols := terminalSize()
+
+	paused := false
+	for {
+		frame, err := replayFrame(r, snapshots, events, id)
+		if err != nil {
+			fmt.Print("\x1b[H\x1b[2J")
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+
+		last := id == len(snapshots)-1
+		if last && !interactive {
+			fmt.Print(renderReplayFrame(frame, rows, cols, "end") + "\n")
+			return
+		}
+		state := "playing"
+		if paused || last {
+			state = "paused"
+		}
+		status := fmt.Sprintf(" %s %gx | space pause  n/p step  g id  m/M marker  +/- speed  q quit", state, speed)
+		fmt.Print(renderReplayFrame(frame, rows, cols, status))
+
+		next := id
+		deadline := time.Now().Add(frameDelay(snapshots, id, speed))
+		for next == id {
+			if !interactive {
+				if !waitUntil(deadline) {
+					return
+				}
+				next = id + 1
+				break
+			}
+			if isInterrupted() {
+				fmt.Print("\x1b[H\x1b[2J")
+				return
+			}
+
+			key := readKey()
+			switch key {
+			case 'q':
+				fmt.Print("\x1b[H\x1b[2J")
+				return
+			case ' ':
+				paused = !paused
+				deadline = time.Now().Add(frameDelay(snapshots, id, speed))
+				next = -1
+			case 'n', KEY_RIGHT:
+				next = id + 1
+			case 'p', KEY_LEFT:
+				next = id - 1
+			case '+':
+				speed *= 2
+				next = -1
+			case '-':
+				speed /= 2
+				next = -1
+			case 'g':
+				if n, ok := readNumber("jump to ID: ", rows); ok {
+					next = n
+				} else {
+					next = -1
+				}
+			case 'm':
+				for _, m := range markers {
+					if m.Snapshot > id {
+						next = m.Snapshot
+						break
+					}
+				}
+			case 'M':
+				for i := len(markers) - 1; i >= 0; i-- {
+					if markers[i].Snapshot < id {
+						next = markers[i].Snapshot
+						break
+					}
+				}
+			}
+			if next == id && !paused && !last && time.Now().After(deadline) {
+				next = id + 1
+			}
+		}
+
+		if next == -1 {
+			continue
+		}
+		if next < 0 {
+			next = 0
+		}
+		if next >= len(snapshots) {
+			next = len(snapshots) - 1
+		}
+		id = next
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// snapshotMutex keeps watch() from committing while another command is
+// writing the work tree and committing a snapshot of its own.
+var snapshotMutex sync.Mutex
+
+type RestoreChange struct {
+	Path   string
+	Action string
+}
+
+func snapshotTreeFiles(r *git.Repository, s Snapshot) (map[string]*object.File, error) {
+	files := map[string]*object.File{}
+	c, err := snapshotCommit(r, s)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		files[f.Name] = f
+		return nil
+	})
+	return files, err
+}
+
+func matchPaths(path string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		if p == "." || path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreChanges lists what restoring paths to snapshot id would change in
+// the work tree. Only files of the target or of the latest snapshot in
+// store are considered, so untracked files are never deleted. The terminal
+// log is never restored.
+func restoreChanges(store SnapshotStore, root string, id int, paths []string) ([]RestoreChange, SnapshotFiles, error) {
+	_, target, err := store.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := store.Len()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, latest, err := store.Get(n - 1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates := map[string]bool{}
+	for path := range target {
+		candidates[path] = true
+	}
+	for path := range latest {
+		candidates[path] = true
+	}
+
+	changes := []RestoreChange{}
+	for path := range candidates {
+		if path == CUI_LOG || !matchPaths(path, paths) {
+			continue
+		}
+		disk, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(path)))
+		exists := err == nil
+
+		f, inTarget := target[path]
+		if !inTarget {
+			if exists {
+				changes = append(changes, RestoreChange{Path: path, Action: "D"})
+			}
+			continue
+		}
+		contents, err := store.Blob(f.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			changes = append(changes, RestoreChange{Path: path, Action: "A"})
+		} else if !bytes.Equal(disk, contents) {
+			changes = append(changes, RestoreChange{Path: path, Action: "M"})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, target, nil
+}
+
+func applyRestore(store SnapshotStore, root string, changes []RestoreChange, target SnapshotFiles) error {
+	for _, change := range changes {
+		path := filepath.Join(root, filepath.FromSlash(change.Path))
+		if change.Action == "D" {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		f := target[change.Path]
+		contents, err := store.Blob(f.Hash)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode.Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, contents, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func confirm(question string) bool {
+	fmt.Print(question + " [y/N] ")
+	line, ok := readLine(interrupted())
+	if !ok {
+		fmt.Println()
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+// live restore [--dry-run] <id> [paths]
+func liveRestore(args []string, projectPath string, couterHTMLPath string) {
+	args, dryRun := hasFlag(args, "--dry-run")
+	if len(args) == 0 {
+		writeCommandOut("usage: live restore [--dry-run] <id> [paths]\n", projectPath, false)
+		return
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	id, err := parseSnapshotID(args[0], snapshots)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	paths := []string{}
+	for _, arg := range args[1:] {
+		path, err := projectRelPath(root, arg)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		paths = append(paths, path)
+	}
+
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	store, err := openSnapshotStore(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	changes, target, err := restoreChanges(store, root, id, paths)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if len(changes) == 0 {
+		writeCommandOut("nothing to restore.\n", projectPath, false)
+		return
+	}
+
+	out := ""
+	for _, change := range changes {
+		out += change.Action + " " + change.Path + "\n"
+	}
+	writeCommandOut(out, projectPath, false)
+	if dryRun {
+		return
+	}
+	if !confirm("restore " + strconv.Itoa(len(changes)) + " files to ID " + strconv.Itoa(id) + "?") {
+		return
+	}
+
+	// the edits made since the last snapshot get a snapshot of their own,
+	// so that the restore snapshot holds the restored files only
+	if _, _, err := putSnapshot(store, root, couterHTMLPath, ""); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if err := applyRestore(store, root, changes, target); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	label := "restore to " + strconv.Itoa(id)
+	if len(args) > 1 {
+		label += ": " + strings.Join(args[1:], " ")
+	}
+	restored, changed, err := putSnapshot(store, root, couterHTMLPath, label)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if !changed {
+		writeCommandOut("the restored files are the same as the latest snapshot.\n", projectPath, false)
+		return
+	}
+	writeEvent(Event{Type: "restore", Label: label}, projectPath, isLiveStarted())
+	writeCommandOut("restored as ID "+strconv.Itoa(restored.ID)+".\n", projectPath, false)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	git "gopkg.in/src-d/go-git.v4"
+	fdiff "gopkg.in/src-d/go-git.v4/plumbing/format/diff"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// SnapshotUpdate is pushed to every browser following the live when a
+// snapshot is committed.
+type SnapshotUpdate struct {
+	Snapshot Snapshot `json:"snapshot"`
+	Files    []string `json:"files"`
+	Changed  []string `json:"changed"`
+	Diff     string   `json:"diff"`
+	Terminal string   `json:"terminal"`
+}
+
+type ServeState struct {
+	History  Snapshots       `json:"history"`
+	Latest   *SnapshotUpdate `json:"latest"`
+	Terminal string          `json:"terminal"`
+}
+
+// LiveServer is the read-only "follow along" view started by "live serve".
+// The handlers answer from the snapshot index kept here, which only
+// publishSnapshot updates, and never load the index themselves.
+type LiveServer struct {
+	server    *http.Server
+	mutex     sync.Mutex
+	r         *git.Repository
+	root      string
+	snapshots Snapshots
+	clients   map[chan []byte]bool
+}
+
+const DEFAULT_SERVE_PORT = 8765
+const DIFF_CONTEXT = 3
+
+var liveServer *LiveServer
+var liveServerMutex sync.Mutex
+
+func currentLiveServer() *LiveServer {
+	liveServerMutex.Lock()
+	defer liveServerMutex.Unlock()
+	return liveServer
+}
+
+// patchLines renders patch as "--- file" headers followed by +, - and
+// context lines, leaving out the terminal log. Long unchanged runs are cut
+// down to DIFF_CONTEXT lines around each change.
+func patchLines(patch *object.Patch) ([]string, []string) {
+	changed := []string{}
+	lines := []string{}
+	for _, fp := range patch.FilePatches() {
+		from, to := fp.Files()
+		name := ""
+		if to != nil {
+			name = to.Path()
+		} else if from != nil {
+			name = from.Path()
+		}
+		if name == CUI_LOG {
+			continue
+		}
+		changed = append(changed, name)
+		lines = append(lines, "--- "+name)
+		for _, chunk := range fp.Chunks() {
+			prefix := " "
+			switch chunk.Type() {
+			case fdiff.Add:
+				prefix = "+"
+			case fdiff.Delete:
+				prefix = "-"
+			}
+			chunkLines := strings.Split(strings.TrimSuffix(chunk.Content(), "\n"), "\n")
+			if chunk.Type() == fdiff.Equal && len(chunkLines) > 2*DIFF_CONTEXT {
+				context := append([]string{}, chunkLines[:DIFF_CONTEXT]...)
+				context = append(context, "...")
+				chunkLines = append(context, chunkLines[len(chunkLines)-DIFF_CONTEXT:]...)
+			}
+			for _, line := range chunkLines {
+				lines = append(lines, prefix+line)
+			}
+		}
+	}
+	return changed, lines
+}
+
+func snapshotUpdate(r *git.Repository, snapshots Snapshots, id int) (SnapshotUpdate, error) {
+	update := SnapshotUpdate{Snapshot: snapshots[id], Files: []string{}, Changed: []string{}}
+
+	c, err := snapshotCommit(r, snapshots[id])
+	if err != nil {
+		return update, err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return update, err
+	}
+	iter := tree.Files()
+	for {
+		f, err := iter.Next()
+		if err != nil {
+			break
+		}
+		update.Files = append(update.Files, f.Name)
+	}
+	sort.Strings(update.Files)
+
+	if c.NumParents() == 0 {
+		return update, nil
+	}
+	parent, err := c.Parent(0)
+	if err != nil {
+		return update, err
+	}
+	patch, err := parent.Patch(c)
+	if err != nil {
+		return update, err
+	}
+	changed, lines := patchLines(patch)
+	update.Changed = changed
+	update.Diff = strings.Join(lines, "\n")
+
+	terminal, err := snapshotFile(r, snapshots[id], CUI_LOG)
+	if err != nil {
+		return update, err
+	}
+	prevTerminal, err := snapshotFile(r, snapshots[id-1], CUI_LOG)
+	if err != nil {
+		return update, err
+	}
+	if strings.HasPrefix(terminal, prevTerminal) {
+		update.Terminal = terminal[len(prevTerminal):]
+	}
+	return update, nil
+}
+
+func (s *LiveServer) repository() (*git.Repository, string, Snapshots) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.r, s.root, s.snapshots
+}
+
+func (s *LiveServer) subscribe() chan []byte {
+	ch := make(chan []byte, 16)
+	s.mutex.Lock()
+	s.clients[ch] = true
+	s.mutex.Unlock()
+	return ch
+}
+
+func (s *LiveServer) unsubscribe(ch chan []byte) {
+	s.mutex.Lock()
+	delete(s.clients, ch)
+	s.mutex.Unlock()
+}
+
+// publishSnapshot is called by watch() after each commit, with the index
+// it has just brought up to date.
+func (s *LiveServer) publishSnapshot(r *git.Repository, projectPath string, snapshots Snapshots) {
+	s.mutex.Lock()
+	if projectPath != s.root || len(snapshots) >= len(s.snapshots) {
+		s.r = r
+		s.root = projectPath
+		s.snapshots = snapshots
+	}
+	s.mutex.Unlock()
+
+	if len(snapshots) == 0 {
+		return
+	}
+	update, err := snapshotUpdate(r, snapshots, len(snapshots)-1)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+func (s *LiveServer) handleIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, serveHTML)
+}
+
+func (s *LiveServer) handleState(w http.ResponseWriter, req *http.Request) {
+	r, _, snapshots := s.repository()
+	state := ServeState{History: snapshots}
+	if len(snapshots) > 0 {
+		update, err := snapshotUpdate(r, snapshots, len(snapshots)-1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		state.Latest = &update
+		state.Terminal, err = snapshotFile(r, snapshots[len(snapshots)-1], CUI_LOG)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+func (s *LiveServer) handleFile(w http.ResponseWriter, req *http.Request) {
+	r, _, snapshots := s.repository()
+	if len(snapshots) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	id := len(snapshots) - 1
+	var err error
+	if value := req.URL.Query().Get("id"); value != "" {
+		id, err = parseSnapshotID(value, snapshots)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	content, err := snapshotFile(r, snapshots[id], req.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, content)
+}
+
+// handleBlame serves the blame of a file with the rewrite count of every
+// line, for the churn heatmap of the file view.
+func (s *LiveServer) handleBlame(w http.ResponseWriter, req *http.Request) {
+	r, _, snapshots := s.repository()
+	if len(snapshots) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	id := len(snapshots) - 1
+	var err error
+	if value := req.URL.Query().Get("id"); value != "" {
+		id, err = parseSnapshotID(value, snapshots)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	lines, err := blameSnapshot(r, snapshots, req.URL.Query().Get("path"), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+func (s *LiveServer) handleEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	for {
+		select {
+		case data := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func lanAddresses(port int) []string {
+	urls := []string{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return urls
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		urls = append(urls, "http://"+ipNet.IP.String()+":"+strconv.Itoa(port)+"/")
+	}
+	return urls
+}
+
+// live serve [port] / live serve stop
+func liveServe(args []string, projectPath string) {
+	liveServerMutex.Lock()
+	defer liveServerMutex.Unlock()
+	if len(args) == 1 && args[0] == "stop" {
+		if liveServer == nil {
+			writeCommandOut("live serve is not running.\n", projectPath, false)
+			return
+		}
+		liveServer.server.Close()
+		liveServer = nil
+		return
+	}
+	if len(args) > 1 {
+		writeCommandOut("usage: live serve [port | stop]\n", projectPath, false)
+		return
+	}
+	if liveServer != nil {
+		writeCommandOut("live serve is already running.\n", projectPath, false)
+		return
+	}
+
+	port := DEFAULT_SERVE_PORT
+	if len(args) == 1 {
+		p, err := strconv.Atoi(args[0])
+		if err != nil {
+			writeCommandOut("port is invalid.\n", projectPath, false)
+			return
+		}
+		port = p
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	s := &LiveServer{r: r, root: root, snapshots: snapshots, clients: map[chan []byte]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/api/state", s.handleState)
+	mux.HandleFunc("/api/file", s.handleFile)
+	mux.HandleFunc("/api/blame", s.handleBlame)
+	mux.HandleFunc("/api/events", s.handleEvents)
+	s.server = &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux}
+
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	liveServer = s
+	go s.server.Serve(listener)
+
+	out := "serving the live on http://localhost:" + strconv.Itoa(port) + "/\n"
+	for _, url := range lanAddresses(port) {
+		out += "  " + url + "\n"
+	}
+	writeCommandOut(out, projectPath, false)
+}
+
+const serveHTML = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>LiveCoding</title>
+<style>
+body{margin:0;font-family:sans-serif;display:grid;grid-template-columns:220px 1fr 160px;grid-template-rows:32px 1fr 35%;height:100vh}
+header{grid-column:1/4;background:#222;color:#eee;padding:6px 10px}
+#tree,#history{overflow:auto;font-size:13px;border-right:1px solid #ccc}
+#tree div,#history div{padding:2px 8px;cursor:pointer}
+#tree .changed{font-weight:bold;color:#06c}
+#view{overflow:auto;margin:0;padding:8px;font-size:13px}
+.add{background:#dfd}.del{background:#fdd}.file{font-weight:bold;margin-top:8px}
+.heat1{background:#dfd}.heat2{background:#ffc}.heat3{background:#fcc}
+#terminal{grid-column:1/4;overflow:auto;margin:0;padding:8px;background:#111;color:#ddd;font-size:13px}
+</style></head><body>
+<header id="title">LiveCoding</header>
+<div id="tree"></div><pre id="view"></pre><div id="history"></div>
+<pre id="terminal"></pre>
+<script>
+var latest=null;
+function esc(s){return s.replace(/&/g,"&amp;").replace(/</g,"&lt;")}
+function time(t){return new Date(t/1e6).toLocaleTimeString()}
+function show(u){
+  latest=u;
+  document.getElementById("title").textContent="LiveCoding  ID: "+u.snapshot.id+"  "+time(u.snapshot.time);
+  var tree=document.getElementById("tree");tree.innerHTML="";
+  u.files.forEach(function(f){var d=document.createElement("div");d.textContent=f;
+    if(u.changed.indexOf(f)>=0)d.className="changed";
+    d.onclick=function(){var q="?path="+encodeURIComponent(f)+"&id="+u.snapshot.id;
+      fetch("/api/blame"+q).then(function(r){if(!r.ok)throw r;return r.json()}).then(function(lines){
+        document.getElementById("view").innerHTML=(lines||[]).map(function(l){
+          var h=l.rewrites>=5?3:l.rewrites>=2?2:l.rewrites>=1?1:0;
+          return '<div class="heat'+h+'" title="'+l.rewrites+' rewrites, ID '+(l.id<0?"?":l.id)+'">'+(esc(l.text)||" ")+'</div>'}).join("")
+      }).catch(function(){fetch("/api/file"+q).then(function(r){return r.text()}).then(function(t){document.getElementById("view").textContent=t})})};
+    tree.appendChild(d)});
+  document.getElementById("view").innerHTML=u.diff.split("\n").map(function(l){
+    var c=l.indexOf("--- ")==0?"file":l[0]=="+"?"add":l[0]=="-"?"del":"";
+    return '<div class="'+c+'">'+esc(l)+'</div>'}).join("");
+}
+function addHistory(s){var d=document.createElement("div");d.textContent=s.id+"  "+time(s.time);
+  var h=document.getElementById("history");h.insertBefore(d,h.firstChild)}
+function addTerminal(t){var p=document.getElementById("terminal");p.textContent+=t;p.scrollTop=p.scrollHeight}
+fetch("/api/state").then(function(r){return r.json()}).then(function(s){
+  (s.history||[]).forEach(addHistory);
+  if(s.latest)show(s.latest);
+  addTerminal(s.terminal||"");
+  new EventSource("/api/events").onmessage=function(e){var u=JSON.parse(e.data);
+    if(latest&&u.snapshot.id<=latest.snapshot.id)return;
+    addHistory(u.snapshot);show(u);addTerminal(u.terminal)};
+});
+</script></body></html>
+`
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// SessionManifest is manifest.json, the first entry of a .livesession
+// archive. Checksums holds the sha256 of every other entry.
+type SessionManifest struct {
+	SchemaVersion int               `json:"schema_version"`
+	Project       string            `json:"project"`
+	Created       int64             `json:"created"`
+	Head          string            `json:"head"`
+	Snapshots     int               `json:"snapshots"`
+	Checksums     map[string]string `json:"checksums"`
+}
+
+const SESSION_SCHEMA_VERSION = 1
+const SESSION_EXTENSION = ".livesession"
+const SESSION_MANIFEST = "manifest.json"
+const SESSION_BUNDLE = "snapshots.bundle"
+const SESSION_TERMINAL = "terminal.log"
+const SESSION_MARKERS = "markers.json"
+
+// sessionEntries are the archive entries after the manifest, in order.
+// The bundle holds the snapshot pack, the others are copies of the live
+// data, the terminal recording and the markers.
+var sessionEntries = []string{SESSION_BUNDLE, SNAPSHOT_INDEX, EVENT_LOG, DELTA_LOG, SESSION_TERMINAL, SESSION_MARKERS}
+
+func isSessionArchive(path string) bool {
+	return strings.HasSuffix(path, SESSION_EXTENSION)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func readLiveData(root string, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(liveDataPath(root, name))
+	if os.IsNotExist(err) {
+		return []byte{}, nil
+	}
+	return data, err
+}
+
+// packSession collects the entries of the project's archive.
+func packSession(r *git.Repository, root string) (SessionManifest, map[string][]byte, error) {
+	manifest := SessionManifest{SchemaVersion: SESSION_SCHEMA_VERSION, Project: filepath.Base(root), Created: time.Now().UnixNano(), Checksums: map[string]string{}}
+	entries := map[string][]byte{}
+
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		return manifest, nil, err
+	}
+	manifest.Snapshots = len(snapshots)
+	manifest.Head = snapshots[len(snapshots)-1].Hash
+
+	bundle, err := ioutil.TempFile("", "live-pack")
+	if err != nil {
+		return manifest, nil, err
+	}
+	bundle.Close()
+	defer os.Remove(bundle.Name())
+	snapshotMutex.Lock()
+	cmd := exec.Command("git", "bundle", "create", bundle.Name(), "HEAD", "--branches")
+	cmd.Dir = root
+	out, err := cmd.CombinedOutput()
+	snapshotMutex.Unlock()
+	if err != nil {
+		return manifest, nil, errors.New(strings.TrimSpace(string(out)))
+	}
+	if entries[SESSION_BUNDLE], err = ioutil.ReadFile(bundle.Name()); err != nil {
+		return manifest, nil, err
+	}
+
+	for _, name := range []string{SNAPSHOT_INDEX, EVENT_LOG, DELTA_LOG} {
+		if entries[name], err = readLiveData(root, name); err != nil {
+			return manifest, nil, err
+		}
+	}
+	terminal, err := snapshotFile(r, snapshots[len(snapshots)-1], CUI_LOG)
+	if err != nil {
+		return manifest, nil, err
+	}
+	entries[SESSION_TERMINAL] = []byte(terminal)
+	events, err := readEvents(root)
+	if err != nil {
+		return manifest, nil, err
+	}
+	if entries[SESSION_MARKERS], err = json.Marshal(sessionMarkers(events)); err != nil {
+		return manifest, nil, err
+	}
+
+	for _, name := range sessionEntries {
+		manifest.Checksums[name] = checksum(entries[name])
+	}
+	return manifest, entries, nil
+}
+
+func writeSessionArchive(path string, manifest SessionManifest, entries map[string][]byte) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zw := gzip.NewWriter(file)
+	tw := tar.NewWriter(zw)
+
+	write := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Unix(0, manifest.Created)}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := write(SESSION_MANIFEST, data); err != nil {
+		return err
+	}
+	for _, name := range sessionEntries {
+		if err := write(name, entries[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// readSessionArchive reads an archive and checks its schema version and
+// checksums.
+func readSessionArchive(path string) (SessionManifest, map[string][]byte, error) {
+	manifest := SessionManifest{}
+	entries := map[string][]byte{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return manifest, nil, errors.New(path + " is not a session archive")
+	}
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return manifest, nil, err
+		}
+		entries[header.Name] = data
+	}
+
+	data, ok := entries[SESSION_MANIFEST]
+	if !ok {
+		return manifest, nil, errors.New(path + " has no " + SESSION_MANIFEST)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, nil, err
+	}
+	if manifest.SchemaVersion > SESSION_SCHEMA_VERSION {
+		return manifest, nil, errors.New(path + " is schema version " + strconv.Itoa(manifest.SchemaVersion) + ", update live to read it")
+	}
+	for name, sum := range manifest.Checksums {
+		data, ok := entries[name]
+		if !ok {
+			return manifest, nil, errors.New(path + " is missing " + name)
+		}
+		if checksum(data) != sum {
+			return manifest, nil, errors.New(path + ": checksum of " + name + " doesn't match")
+		}
+	}
+	return manifest, entries, nil
+}
+
+// unpackSessionEntries writes the checked entries of an archive as a
+// project in dir, with the work tree checked out at the last snapshot.
+func unpackSessionEntries(entries map[string][]byte, dir string) error {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return errors.New(dir + " already exists")
+	}
+
+	bundle, err := ioutil.TempFile("", "live-unpack")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bundle.Name())
+	if _, err := bundle.Write(entries[SESSION_BUNDLE]); err != nil {
+		bundle.Close()
+		return err
+	}
+	bundle.Close()
+
+	for _, args := range [][]string{{"clone", "-q", bundle.Name(), dir}, {"-C", dir, "remote", "remove", "origin"}} {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			return errors.New(strings.TrimSpace(string(out)))
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, LIVE_DATA_DIR), 0755); err != nil {
+		return err
+	}
+	for _, name := range []string{SNAPSHOT_INDEX, EVENT_LOG, DELTA_LOG} {
+		if len(entries[name]) == 0 {
+			continue
+		}
+		if err := ioutil.WriteFile(liveDataPath(dir, name), entries[name], 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackSessionTemp unpacks an archive into a temporary directory named
+// after the project. The returned function removes it.
+func unpackSessionTemp(archivePath string) (string, func(), error) {
+	manifest, entries, err := readSessionArchive(archivePath)
+	if err != nil {
+		return "", nil, err
+	}
+	tmp, err := ioutil.TempDir("", "live-session")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(tmp)
+	}
+	dir := filepath.Join(tmp, filepath.Base(manifest.Project))
+	if err := unpackSessionEntries(entries, dir); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// openSessionPath opens a project, or an archive unpacked into a temporary
+// directory. The returned function removes it.
+func openSessionPath(path string) (*git.Repository, string, func(), error) {
+	cleanup := func() {}
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", cleanup, err
+	}
+	if isSessionArchive(root) {
+		if root, cleanup, err = unpackSessionTemp(root); err != nil {
+			return nil, "", func() {}, err
+		}
+	}
+	r, err := git.PlainOpen(root)
+	if err != nil {
+		return nil, root, cleanup, err
+	}
+	return r, root, cleanup, nil
+}
+
+// live pack [-o file]
+func livePack(args []string, projectPath string) {
+	args, outputPath, _ := flagValue(args, "-o")
+	if len(args) != 0 {
+		writeCommandOut("usage: live pack [-o file]\n", projectPath, false)
+		return
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if err := syncGitView(r, root); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if outputPath == "" {
+		outputPath = filepath.Join(filepath.Dir(root), filepath.Base(root)+SESSION_EXTENSION)
+	}
+
+	manifest, entries, err := packSession(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if err := writeSessionArchive(outputPath, manifest, entries); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut("wrote "+outputPath+" ("+strconv.Itoa(manifest.Snapshots)+" snapshots).\n", projectPath, false)
+}
+
+// live unpack <archive> [dir]
+func liveUnpack(args []string, projectPath string) {
+	if len(args) == 0 || len(args) > 2 {
+		writeCommandOut("usage: live unpack <archive> [dir]\n", projectPath, false)
+		return
+	}
+	manifest, entries, err := readSessionArchive(args[0])
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	dir := filepath.Base(manifest.Project)
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	if err := unpackSessionEntries(entries, dir); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut("unpacked into "+dir+", continue it with \"live start "+dir+"\".\n", projectPath, false)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// ForegroundCommand is a shell command run from the prompt. It gets its own
+// process group so that the signals typed at the terminal reach the
+// capture first, which passes them on to the group.
+type ForegroundCommand struct {
+	cmd      *exec.Cmd
+	line     string
+	start    time.Time
+	snapshot int
+	output   *bytes.Buffer
+	done     chan error
+	stopped  chan bool
+}
+
+var foregroundMutex sync.Mutex
+var foreground *ForegroundCommand
+var stoppedCommands = []*ForegroundCommand{}
+
+// interrupt is closed by Ctrl-C while the prompt waits for a line or a
+// live command runs in the capture itself, as replay, perform, bisect and
+// the confirm prompts do. They watch it and stop. The prompt makes a new
+// one before every line.
+var interruptMutex sync.Mutex
+var interrupt = make(chan struct{})
+
+// signalProjectPath is the project the prompt is in, for the signal
+// handler to close the recording of on SIGTERM and SIGHUP.
+var signalProjectPath string
+
+func newInterrupt(projectPath string) {
+	interruptMutex.Lock()
+	interrupt = make(chan struct{})
+	signalProjectPath = projectPath
+	interruptMutex.Unlock()
+}
+
+func interrupted() <-chan struct{} {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	return interrupt
+}
+
+func isInterrupted() bool {
+	select {
+	case <-interrupted():
+		return true
+	default:
+		return false
+	}
+}
+
+// waitUntil sleeps until t, and returns false if Ctrl-C comes first.
+func waitUntil(t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-interrupted():
+		return false
+	}
+}
+
+func interruptCommand() {
+	interruptMutex.Lock()
+	select {
+	case <-interrupt:
+	default:
+		close(interrupt)
+	}
+	interruptMutex.Unlock()
+}
+
+// The terminal is read by a single goroutine of its own that passes on
+// every byte, so that the prompt and the keys of a replay take turns on
+// the same input: a line given up on Ctrl-C is kept for the next prompt,
+// and keys typed ahead are not lost between readers.
+const STDIN_RETRY_INTERVAL = 100 * time.Millisecond
+
+var stdinMutex sync.Mutex
+var stdinOnce sync.Once
+var stdinBytes = make(chan byte, 4096)
+var stdinLine []byte
+
+func readStdin() {
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		for _, b := range buf[:n] {
+			stdinBytes <- b
+		}
+		if n == 0 && err != nil {
+			// a raw terminal returns nothing after 100ms, a closed one
+			// keeps doing so
+			time.Sleep(STDIN_RETRY_INTERVAL)
+		}
+	}
+}
+
+// readLine returns the next line typed at the terminal, or false if stop
+// is closed first. What was typed of the line is then kept for the next
+// call.
+func readLine(stop <-chan struct{}) (string, bool) {
+	stdinOnce.Do(func() { go readStdin() })
+	stdinMutex.Lock()
+	defer stdinMutex.Unlock()
+	for {
+		select {
+		case b := <-stdinBytes:
+			if b == '\n' {
+				line := string(bytes.TrimSuffix(stdinLine, []byte("\r")))
+				stdinLine = nil
+				return line, true
+			}
+			stdinLine = append(stdinLine, b)
+		case <-stop:
+			return "", false
+		}
+	}
+}
+
+// readByte returns the next byte typed at the terminal, or false if none
+// comes within timeout.
+func readByte(timeout time.Duration) (byte, bool) {
+	stdinOnce.Do(func() { go readStdin() })
+	select {
+	case b := <-stdinBytes:
+		return b, true
+	case <-time.After(timeout):
+		return 0, false
+	}
+}
+
+func startCommand(line string) (*ForegroundCommand, error) {
+	f := &ForegroundCommand{
+		cmd:      exec.Command("bash", "-c", line),
+		line:     line,
+		start:    time.Now(),
+		snapshot: snapshotID(),
+		output:   &bytes.Buffer{},
+		done:     make(chan error, 1),
+		stopped:  make(chan bool, 1),
+	}
+	f.cmd.Stdout = f.output
+	f.cmd.Stderr = f.output
+	f.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := f.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		f.done <- f.cmd.Wait()
+	}()
+	return f, nil
+}
+
+// waitCommand waits until f exits, or is stopped with Ctrl-Z and put
+// aside for "fg".
+func waitCommand(f *ForegroundCommand, projectPath string, couterHTMLPath string) {
+	foregroundMutex.Lock()
+	foreground = f
+	foregroundMutex.Unlock()
+
+	var err error
+	stopped := false
+	select {
+	case err = <-f.done:
+	case <-f.stopped:
+		stopped = true
+	}
+
+	foregroundMutex.Lock()
+	foreground = nil
+	if stopped {
+		stoppedCommands = append(stoppedCommands, f)
+	}
+	foregroundMutex.Unlock()
+
+	if stopped {
+		writeCommandOut("\n[stopped] "+f.line+" (\"fg\" to continue)\n", projectPath, isLiveStarted())
+		return
+	}
+	out := f.output.String()
+	writeCommandOut(out, projectPath, isLiveStarted())
+	recordCommand(f.line, out, err, f.snapshot, time.Since(f.start), projectPath, couterHTMLPath, isLiveStarted())
+}
+
+// resumeCommand continues the last stopped command in the foreground.
+func resumeCommand(projectPath string, couterHTMLPath string) {
+	foregroundMutex.Lock()
+	if len(stoppedCommands) == 0 {
+		foregroundMutex.Unlock()
+		writeCommandOut("fg: there is no stopped command.\n", projectPath, isLiveStarted())
+		return
+	}
+	f := stoppedCommands[len(stoppedCommands)-1]
+	stoppedCommands = stoppedCommands[:len(stoppedCommands)-1]
+	foregroundMutex.Unlock()
+
+	writeCommandOut(f.line+"\n", projectPath, isLiveStarted())
+	syscall.Kill(-f.cmd.Process.Pid, syscall.SIGCONT)
+	waitCommand(f, projectPath, couterHTMLPath)
+}
+
+// finalSnapshot commits what changed since the last snapshot, labelled,
+// without waiting for watch().
+func finalSnapshot(projectPath string, couterHTMLPath string, label string) error {
+	r, err := git.PlainOpen(projectPath)
+	if err != nil {
+		return err
+	}
+	store, err := openSnapshotStore(r, projectPath)
+	if err != nil {
+		return err
+	}
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	_, _, err = putSnapshot(store, projectPath, couterHTMLPath, label)
+	return err
+}
+
+// putSnapshot commits what changed since the last snapshot to store the
+// same way watch() does, labelled, and checks the deltas recorded for it.
+// It returns the new snapshot, or false if nothing changed. snapshotMutex must be held.
+func putSnapshot(store SnapshotStore, projectPath string, couterHTMLPath string, label string) (Snapshot, bool, error) {
+	changedFiles, err := store.Changes()
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	if len(changedFiles) == 0 {
+		return Snapshot{}, false, nil
+	}
+
+	snapshot, err := store.Put(time.Now().UnixNano(), label)
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	if isLiveStarted() == false {
+		return snapshot, true, nil
+	}
+	setSnapshotID(snapshot.ID, snapshot.Time)
+	if d := currentDeltaRecorder(); d != nil {
+		if err := d.verifyDeltas(store, snapshot.ID, projectPath); err != nil {
+			return snapshot, true, err
+		}
+	}
+	err, _ = createCounterHTML(counterMessage(snapshot.ID), couterHTMLPath)
+	return snapshot, true, err
+}
+
+// shutdown passes sig on to every command started from the prompt, and
+// closes the recording with a final snapshot and a stop event.
+func shutdown(sig syscall.Signal, projectPath string, couterHTMLPath string) {
+	foregroundMutex.Lock()
+	if foreground != nil {
+		syscall.Kill(-foreground.cmd.Process.Pid, sig)
+	}
+	for _, f := range stoppedCommands {
+		syscall.Kill(-f.cmd.Process.Pid, sig)
+		syscall.Kill(-f.cmd.Process.Pid, syscall.SIGCONT)
+	}
+	foregroundMutex.Unlock()
+
+	if isLiveStarted() == false {
+		return
+	}
+	if err := finalSnapshot(projectPath, couterHTMLPath, "final snapshot on "+sig.String()); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+	}
+	writeEvent(Event{Type: "stop", Label: sig.String()}, projectPath, isLiveStarted())
+	stopControlSocket()
+	setLiveStarted(false)
+}
+
+// handleSignals keeps Ctrl-C, Ctrl-Z and Ctrl-\ from stopping the capture
+// and sends them to the command running in the foreground instead. With
+// no command in the foreground Ctrl-C interrupts the prompt or the live
+// command running in the capture. SIGTERM and SIGHUP close the recording
+// and exit.
+func handleSignals(couterHTMLPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTSTP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range signals {
+		sig := s.(syscall.Signal)
+		if sig == syscall.SIGTERM || sig == syscall.SIGHUP {
+			interruptMutex.Lock()
+			projectPath := signalProjectPath
+			interruptMutex.Unlock()
+			shutdown(sig, projectPath, couterHTMLPath)
+			os.Exit(0)
+		}
+
+		foregroundMutex.Lock()
+		f := foreground
+		foregroundMutex.Unlock()
+		if f == nil {
+			if sig == syscall.SIGINT {
+				interruptCommand()
+			}
+			continue
+		}
+		syscall.Kill(-f.cmd.Process.Pid, sig)
+		if sig == syscall.SIGTSTP {
+			select {
+			case f.stopped <- true:
+			default:
+			}
+		}
+	}
+}
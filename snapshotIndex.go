@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Snapshot is one commit made by watch(). ID is the number shown on the
+// counter page, Time is the unix nano time written as the commit message.
+// Snapshots committed by commands such as "live restore" have a Label in
+// the rest of the message. Author is only set on the snapshots of "live
+// merge", as the author of the commit.
+type Snapshot struct {
+	ID     int    `json:"id"`
+	Hash   string `json:"hash"`
+	Time   int64  `json:"time"`
+	Label  string `json:"label,omitempty"`
+	Author string `json:"author,omitempty"`
+}
+
+type Snapshots []Snapshot
+
+// live data is kept under .git so that it is never picked up by "git add ."
+// in watch(), but still goes out with "live upload".
+const LIVE_DATA_DIR = ".git/live"
+const SNAPSHOT_INDEX = "snapshots.json"
+
+func liveDataPath(projectPath string, name string) string {
+	return filepath.Join(projectPath, LIVE_DATA_DIR, name)
+}
+
+func snapshotTime(c *object.Commit) int64 {
+	firstLine := strings.SplitN(c.Message, "\n", 2)[0]
+	t, err := strconv.ParseInt(strings.TrimSpace(firstLine), 10, 64)
+	if err != nil {
+		return c.Author.When.UnixNano()
+	}
+	return t
+}
+
+func snapshotLabel(c *object.Commit) string {
+	parts := strings.SplitN(c.Message, "\n", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// loadSnapshotIndex returns every snapshot from the first commit to HEAD.
+// The new snapshots of a project kept in the local store are committed to
+// git first, so that the commands reading git see all of them.
+func loadSnapshotIndex(r *git.Repository, projectPath string) (Snapshots, error) {
+	if err := syncGitView(r, projectPath); err != nil {
+		return nil, err
+	}
+	return loadGitSnapshotIndex(r, projectPath)
+}
+
+// loadGitSnapshotIndex returns every commit from the first one to HEAD.
+// The index is cached in .git/live/snapshots.json and only the commits made
+// since the last call are walked.
+func loadGitSnapshotIndex(r *git.Repository, projectPath string) (Snapshots, error) {
+	snapshots := Snapshots{}
+	indexPath := liveDataPath(projectPath, SNAPSHOT_INDEX)
+	if data, err := ioutil.ReadFile(indexPath); err == nil {
+		if err := json.Unmarshal(data, &snapshots); err != nil {
+			snapshots = Snapshots{}
+		}
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 && snapshots[len(snapshots)-1].Hash == head.Hash().String() {
+		return snapshots, nil
+	}
+
+	known := map[string]int{}
+	for i, s := range snapshots {
+		known[s.Hash] = i
+	}
+
+	newer := Snapshots{}
+	c, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if i, ok := known[c.Hash.String()]; ok {
+			snapshots = snapshots[:i+1]
+			break
+		}
+		newer = append(newer, Snapshot{Hash: c.Hash.String(), Time: snapshotTime(c), Label: snapshotLabel(c), Author: c.Author.Name})
+		if c.NumParents() == 0 {
+			snapshots = Snapshots{}
+			break
+		}
+		c, err = c.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := len(newer) - 1; i >= 0; i-- {
+		s := newer[i]
+		s.ID = len(snapshots)
+		snapshots = append(snapshots, s)
+	}
+
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0755); err != nil {
+		return nil, err
+	}
+	// written aside and renamed, so that a command reading the index while
+	// watch() writes it never sees half of it
+	tmp, err := ioutil.TempFile(filepath.Dir(indexPath), SNAPSHOT_INDEX)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), indexPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// parseSnapshotID parses "@12" or "12". A negative ID counts from the latest
+// snapshot, so "@-1" is the one before HEAD.
+func parseSnapshotID(value string, snapshots Snapshots) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(value, "@"))
+	if err != nil {
+		return 0, errors.New("snapshot id is invalid")
+	}
+	if id < 0 {
+		id = len(snapshots) - 1 + id
+	}
+	if id < 0 || id >= len(snapshots) {
+		return 0, errors.New("snapshot " + value + " doesn't exist")
+	}
+	return id, nil
+}
+
+func snapshotCommit(r *git.Repository, s Snapshot) (*object.Commit, error) {
+	return r.CommitObject(plumbing.NewHash(s.Hash))
+}
+
+// snapshotFile returns the contents of path in the snapshot, or "" if the
+// file did not exist at that time.
+func snapshotFile(r *git.Repository, s Snapshot, path string) (string, error) {
+	c, err := snapshotCommit(r, s)
+	if err != nil {
+		return "", err
+	}
+	f, err := c.File(path)
+	if err == object.ErrFileNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return f.Contents()
+}
+
+func formatSnapshotTime(t int64) string {
+	return time.Unix(0, t).Format("15:04:05")
+}
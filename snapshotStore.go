@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// SnapshotStore keeps the snapshots of a project. The git shadow repository
+// is the default one, "store": "local" in .live.json selects the local
+// store.
+type SnapshotStore interface {
+	// Changes lists the files of the work tree that differ from the latest
+	// snapshot.
+	Changes() ([]string, error)
+	// Put snapshots the work tree at time t.
+	Put(t int64, label string) (Snapshot, error)
+	Get(id int) (Snapshot, SnapshotFiles, error)
+	// List returns the snapshots from ID from up to, but not including, to.
+	List(from int, to int) (Snapshots, error)
+	Len() (int, error)
+	Blob(hash string) ([]byte, error)
+}
+
+// StoredFile is a file of a snapshot, Hash is the hash of its contents in
+// the store.
+type StoredFile struct {
+	Hash string      `json:"hash"`
+	Mode os.FileMode `json:"mode"`
+}
+
+type SnapshotFiles map[string]StoredFile
+
+const STORE_GIT = "git"
+const STORE_LOCAL = "local"
+
+// gitViewMutex keeps two commands from writing the git view of a local
+// store at the same time.
+var gitViewMutex sync.Mutex
+
+// openSnapshotStore opens the store selected in the project's .live.json.
+func openSnapshotStore(r *git.Repository, projectPath string) (SnapshotStore, error) {
+	config, err := loadProjectConfig(projectPath)
+	if err != nil {
+		return nil, errors.New(PROJECT_CONFIG + ": " + err.Error())
+	}
+	switch config.Store {
+	case "", STORE_GIT:
+		return &GitStore{r: r, root: projectPath}, nil
+	case STORE_LOCAL:
+		return openLocalStore(projectPath)
+	}
+	return nil, errors.New(PROJECT_CONFIG + ": store must be " + STORE_GIT + " or " + STORE_LOCAL)
+}
+
+// storedFile returns the contents of path in files, or "" if it is not
+// there.
+func storedFile(store SnapshotStore, files SnapshotFiles, path string) (string, error) {
+	f, ok := files[path]
+	if !ok {
+		return "", nil
+	}
+	data, err := store.Blob(f.Hash)
+	return string(data), err
+}
+
+func snapshotMessage(t int64, label string) string {
+	message := strconv.FormatInt(t, 10)
+	if label != "" {
+		message += "\n\n" + label
+	}
+	return message
+}
+
+// GitStore commits every snapshot to the project's own repository.
+type GitStore struct {
+	r    *git.Repository
+	root string
+}
+
+func (s *GitStore) Changes() ([]string, error) {
+	w, err := s.r.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := w.Status()
+	if err != nil {
+		return nil, err
+	}
+	changedFiles := []string{}
+	for path := range status {
+		changedFiles = append(changedFiles, path)
+	}
+	sort.Strings(changedFiles)
+	return changedFiles, nil
+}
+
+func (s *GitStore) Put(t int64, label string) (Snapshot, error) {
+	w, err := s.r.Worktree()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	cmd := exec.Command("git", "add", ".")
+	cmd.Dir = s.root
+	if err := cmd.Run(); err != nil {
+		return Snapshot{}, err
+	}
+	_, err = w.Commit(snapshotMessage(t, label), &git.CommitOptions{
+		Author: &object.Signature{
+			When: time.Now(),
+		},
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	w.Checkout(&git.CheckoutOptions{
+		Branch: plumbing.NewBranchReferenceName("master"),
+	})
+
+	snapshots, err := loadGitSnapshotIndex(s.r, s.root)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snapshots[len(snapshots)-1], nil
+}
+
+func (s *GitStore) Get(id int) (Snapshot, SnapshotFiles, error) {
+	snapshots, err := loadGitSnapshotIndex(s.r, s.root)
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+	if id < 0 || id >= len(snapshots) {
+		return Snapshot{}, nil, errors.New("snapshot " + strconv.Itoa(id) + " doesn't exist")
+	}
+	treeFiles, err := snapshotTreeFiles(s.r, snapshots[id])
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+	files := SnapshotFiles{}
+	for name, f := range treeFiles {
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return Snapshot{}, nil, err
+		}
+		files[name] = StoredFile{Hash: f.Hash.String(), Mode: mode}
+	}
+	return snapshots[id], files, nil
+}
+
+func (s *GitStore) List(from int, to int) (Snapshots, error) {
+	snapshots, err := loadGitSnapshotIndex(s.r, s.root)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotRange(snapshots, from, to), nil
+}
+
+func (s *GitStore) Len() (int, error) {
+	return gitSnapshotCount(s.r, s.root)
+}
+
+func (s *GitStore) Blob(hash string) ([]byte, error) {
+	blob, err := s.r.BlobObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func snapshotRange(snapshots Snapshots, from int, to int) Snapshots {
+	if from < 0 {
+		from = 0
+	}
+	if to > len(snapshots) {
+		to = len(snapshots)
+	}
+	if from >= to {
+		return Snapshots{}
+	}
+	return append(Snapshots{}, snapshots[from:to]...)
+}
+
+// gitSnapshotCount is the number of snapshots in git, 0 before the first
+// commit.
+func gitSnapshotCount(r *git.Repository, projectPath string) (int, error) {
+	if _, err := r.Head(); err == plumbing.ErrReferenceNotFound {
+		return 0, nil
+	}
+	snapshots, err := loadGitSnapshotIndex(r, projectPath)
+	return len(snapshots), err
+}
+
+// syncGitView commits the new snapshots of a project kept in the local
+// store to git, so that the commands reading git see them all.
+func syncGitView(r *git.Repository, projectPath string) error {
+	config, err := loadProjectConfig(projectPath)
+	if err != nil {
+		return errors.New(PROJECT_CONFIG + ": " + err.Error())
+	}
+	if config.Store != STORE_LOCAL {
+		return nil
+	}
+	s, err := openLocalStore(projectPath)
+	if err != nil {
+		return err
+	}
+	return syncStores(r, s)
+}
+
+// syncStores brings the local store and the git repository to the same
+// snapshots. Snapshots only in git, made before the project moved to the
+// local store, are imported, and snapshots only in the local store are
+// committed to git, with the index put at the new HEAD so that git status
+// is right.
+func syncStores(r *git.Repository, s *LocalStore) error {
+	gitViewMutex.Lock()
+	defer gitViewMutex.Unlock()
+
+	g := &GitStore{r: r, root: s.root}
+	gitCount, err := gitSnapshotCount(r, s.root)
+	if err != nil {
+		return err
+	}
+	localCount, err := s.Len()
+	if err != nil {
+		return err
+	}
+
+	for id := localCount; id < gitCount; id++ {
+		snapshot, files, err := g.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := s.importSnapshot(g, snapshot, files); err != nil {
+			return err
+		}
+	}
+	if localCount <= gitCount {
+		return nil
+	}
+
+	parent := plumbing.ZeroHash
+	if gitCount > 0 {
+		head, err := r.Head()
+		if err != nil {
+			return err
+		}
+		parent = head.Hash()
+	}
+	for id := gitCount; id < localCount; id++ {
+		if parent, err = s.commitSnapshot(r, id, parent); err != nil {
+			return err
+		}
+	}
+	if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.Master, parent)); err != nil {
+		return err
+	}
+	cmd := exec.Command("git", "reset", "-q")
+	cmd.Dir = s.root
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// commitSnapshot writes local snapshot id to git as a child of parent.
+func (s *LocalStore) commitSnapshot(r *git.Repository, id int, parent plumbing.Hash) (plumbing.Hash, error) {
+	snapshot, files, err := s.Get(id)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	treeFiles := map[string]treeFile{}
+	for name, f := range files {
+		hash, err := s.gitBlob(r, f.Hash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		mode, err := filemode.NewFromOSFileMode(f.Mode)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		treeFiles[name] = treeFile{hash: hash, mode: mode}
+	}
+	treeHash, err := writeTree(r.Storer, treeFiles)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	signature := object.Signature{When: time.Unix(0, snapshot.Time)}
+	commit := &object.Commit{Author: signature, Committer: signature, Message: snapshotMessage(snapshot.Time, snapshot.Label), TreeHash: treeHash}
+	if !parent.IsZero() {
+		commit.ParentHashes = []plumbing.Hash{parent}
+	}
+	obj := r.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.Storer.SetEncodedObject(obj)
+}
+
+// gitBlob copies a blob of the local store to git, once. The copy is
+// remembered under git/<hash>, but checked for, as a repository cloned
+// back from an archive may not have it.
+func (s *LocalStore) gitBlob(r *git.Repository, hash string) (plumbing.Hash, error) {
+	if gitHash, ok := s.index.Get("git/" + hash); ok {
+		if r.Storer.HasEncodedObject(plumbing.NewHash(gitHash)) == nil {
+			return plumbing.NewHash(gitHash), nil
+		}
+	}
+	data, err := s.Blob(hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	obj := r.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	writer, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	writer.Close()
+	gitHash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return gitHash, s.index.Put(map[string]string{"git/" + hash: gitHash.String()})
+}
+
+// setProjectStore writes the store to .live.json, leaving the other
+// settings as they are.
+func setProjectStore(projectPath string, store string) error {
+	path := filepath.Join(projectPath, PROJECT_CONFIG)
+	config := map[string]json.RawMessage{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+	}
+	if store == STORE_GIT {
+		delete(config, "store")
+	} else {
+		config["store"], _ = json.Marshal(store)
+	}
+	data, err = json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// live store [git|local]
+func liveStore(args []string, projectPath string) {
+	if len(args) > 1 || (len(args) == 1 && args[0] != STORE_GIT && args[0] != STORE_LOCAL) {
+		writeCommandOut("usage: live store [git|local]\n", projectPath, false)
+		return
+	}
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	config, err := loadProjectConfig(root)
+	if err != nil {
+		writeCommandOut(PROJECT_CONFIG+": "+err.Error()+"\n", projectPath, false)
+		return
+	}
+	current := config.Store
+	if current == "" {
+		current = STORE_GIT
+	}
+
+	if len(args) == 0 {
+		store, err := openSnapshotStore(r, root)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		n, err := store.Len()
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		writeCommandOut("snapshots are kept in the "+current+" store ("+strconv.Itoa(n)+" snapshots).\n", projectPath, false)
+		return
+	}
+	if args[0] == current {
+		writeCommandOut("snapshots are already kept in the "+current+" store.\n", projectPath, false)
+		return
+	}
+	if isLiveStarted() {
+		writeCommandOut("live is started, please stop live before moving the snapshots.\n", projectPath, false)
+		return
+	}
+
+	// both ways, the local store is brought up to date with git, or git
+	// with the local store
+	local, err := openLocalStore(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if err := syncStores(r, local); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if err := setProjectStore(root, args[0]); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	n, err := local.Len()
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut("moved "+strconv.Itoa(n)+" snapshots to the "+args[0]+" store.\n", projectPath, false)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+type FileChurn struct {
+	Path      string `json:"path"`
+	Snapshots int    `json:"snapshots"`
+	Added     int    `json:"added"`
+	Removed   int    `json:"removed"`
+}
+
+type CommandStat struct {
+	Command  string `json:"command"`
+	Runs     int    `json:"runs"`
+	Failures int    `json:"failures"`
+}
+
+// RedToGreen is the time from a failing build to the next passing run of
+// the same command.
+type RedToGreen struct {
+	Command  string  `json:"command"`
+	FailedAt int64   `json:"failed_at"`
+	PassedAt int64   `json:"passed_at"`
+	Seconds  float64 `json:"seconds"`
+}
+
+type SessionStats struct {
+	Snapshots        int           `json:"snapshots"`
+	Start            int64         `json:"start"`
+	End              int64         `json:"end"`
+	ActiveSeconds    float64       `json:"active_seconds"`
+	IdleSeconds      float64       `json:"idle_seconds"`
+	IdleGaps         int           `json:"idle_gaps"`
+	LinesAdded       int           `json:"lines_added"`
+	LinesRemoved     int           `json:"lines_removed"`
+	AddedPerMinute   float64       `json:"added_per_minute"`
+	RemovedPerMinute float64       `json:"removed_per_minute"`
+	Files            []FileChurn   `json:"files"`
+	Commands         []CommandStat `json:"commands"`
+	RedToGreen       []RedToGreen  `json:"red_to_green"`
+	Kata             *Kata         `json:"kata,omitempty"`
+}
+
+const DEFAULT_IDLE_SECONDS = 120
+
+func computeStats(r *git.Repository, snapshots Snapshots, events Events, idle time.Duration) (SessionStats, error) {
+	stats := SessionStats{
+		Snapshots:  len(snapshots),
+		Files:      []FileChurn{},
+		Commands:   []CommandStat{},
+		RedToGreen: []RedToGreen{},
+	}
+
+	activity := []int64{}
+	for _, s := range snapshots {
+		activity = append(activity, s.Time)
+	}
+	for _, e := range events {
+		if e.Type != "pause" {
+			activity = append(activity, e.Time)
+		}
+	}
+	sort.Slice(activity, func(i, j int) bool { return activity[i] < activity[j] })
+
+	if len(activity) > 0 {
+		stats.Start = activity[0]
+		stats.End = activity[len(activity)-1]
+	}
+	for i := 1; i < len(activity); i++ {
+		gap := time.Duration(activity[i] - activity[i-1])
+		if gap > idle {
+			stats.IdleGaps++
+			stats.IdleSeconds += gap.Seconds()
+		} else {
+			stats.ActiveSeconds += gap.Seconds()
+		}
+	}
+
+	files := map[string]*FileChurn{}
+	for _, s := range snapshots {
+		c, err := snapshotCommit(r, s)
+		if err != nil {
+			return stats, err
+		}
+		fileStats, err := c.Stats()
+		if err != nil {
+			return stats, err
+		}
+		for _, fs := range fileStats {
+			if fs.Name == CUI_LOG {
+				continue
+			}
+			f, ok := files[fs.Name]
+			if !ok {
+				f = &FileChurn{Path: fs.Name}
+				files[fs.Name] = f
+			}
+			f.Snapshots++
+			f.Added += fs.Addition
+			f.Removed += fs.Deletion
+			stats.LinesAdded += fs.Addition
+			stats.LinesRemoved += fs.Deletion
+		}
+	}
+	for _, f := range files {
+		stats.Files = append(stats.Files, *f)
+	}
+	sort.Slice(stats.Files, func(i, j int) bool {
+		if stats.Files[i].Snapshots != stats.Files[j].Snapshots {
+			return stats.Files[i].Snapshots > stats.Files[j].Snapshots
+		}
+		return stats.Files[i].Path < stats.Files[j].Path
+	})
+
+	if minutes := stats.ActiveSeconds / 60; minutes > 0 {
+		stats.AddedPerMinute = float64(stats.LinesAdded) / minutes
+		stats.RemovedPerMinute = float64(stats.LinesRemoved) / minutes
+	}
+
+	commands := map[string]*CommandStat{}
+	failing := map[string]int64{}
+	for _, e := range events {
+		if e.Type != "command" {
+			continue
+		}
+		c, ok := commands[e.Command]
+		if !ok {
+			c = &CommandStat{Command: e.Command}
+			commands[e.Command] = c
+		}
+		c.Runs++
+		if e.ExitCode != 0 {
+			c.Failures++
+		}
+
+		if e.Build == nil {
+			continue
+		}
+		failedAt, wasFailing := failing[e.Command]
+		if !e.Build.Passed && !wasFailing {
+			failing[e.Command] = e.Time
+		} else if e.Build.Passed && wasFailing {
+			stats.RedToGreen = append(stats.RedToGreen, RedToGreen{
+				Command:  e.Command,
+				FailedAt: failedAt,
+				PassedAt: e.Time,
+				Seconds:  time.Duration(e.Time - failedAt).Seconds(),
+			})
+			delete(failing, e.Command)
+		}
+	}
+	for _, c := range commands {
+		stats.Commands = append(stats.Commands, *c)
+	}
+	sort.Slice(stats.Commands, func(i, j int) bool {
+		if stats.Commands[i].Runs != stats.Commands[j].Runs {
+			return stats.Commands[i].Runs > stats.Commands[j].Runs
+		}
+		return stats.Commands[i].Command < stats.Commands[j].Command
+	})
+
+	return stats, nil
+}
+
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func statsTable(stats SessionStats) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(w, "snapshots\t%d\n", stats.Snapshots)
+	if stats.Start != 0 {
+		fmt.Fprintf(w, "session\t%s - %s\n", formatSnapshotTime(stats.Start), formatSnapshotTime(stats.End))
+	}
+	fmt.Fprintf(w, "active\t%s\n", formatSeconds(stats.ActiveSeconds))
+	fmt.Fprintf(w, "idle\t%s (%d gaps)\n", formatSeconds(stats.IdleSeconds), stats.IdleGaps)
+	fmt.Fprintf(w, "lines\t+%d -%d (+%.1f -%.1f per minute)\n", stats.LinesAdded, stats.LinesRemoved, stats.AddedPerMinute, stats.RemovedPerMinute)
+	if stats.Kata != nil {
+		fmt.Fprintf(w, "kata\t%s\n", kataSummary(stats.Kata))
+	}
+
+	fmt.Fprintf(w, "\nFILE\tSNAPSHOTS\tADDED\tREMOVED\n")
+	for i, f := range stats.Files {
+		if i == 10 {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", f.Path, f.Snapshots, f.Added, f.Removed)
+	}
+
+	fmt.Fprintf(w, "\nCOMMAND\tRUNS\tFAILURES\n")
+	for _, c := range stats.Commands {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", c.Command, c.Runs, c.Failures)
+	}
+
+	if len(stats.RedToGreen) > 0 {
+		fmt.Fprintf(w, "\nRED TO GREEN\tFAILED\tPASSED\tTIME\n")
+		for _, rg := range stats.RedToGreen {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", rg.Command, formatSnapshotTime(rg.FailedAt), formatSnapshotTime(rg.PassedAt), formatSeconds(rg.Seconds))
+		}
+	}
+
+	w.Flush()
+	return buf.String()
+}
+
+// live stats [--idle seconds] [--json]
+func liveStats(args []string, projectPath string) {
+	args, jsonOutput := hasFlag(args, "--json")
+	args, idleValue, _ := flagValue(args, "--idle")
+	if len(args) != 0 {
+		writeCommandOut("usage: live stats [--idle seconds] [--json]\n", projectPath, false)
+		return
+	}
+
+	idle := DEFAULT_IDLE_SECONDS * time.Second
+	if idleValue != "" {
+		seconds, err := strconv.Atoi(idleValue)
+		if err != nil || seconds <= 0 {
+			writeCommandOut("idle seconds are invalid.\n", projectPath, false)
+			return
+		}
+		idle = time.Duration(seconds) * time.Second
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	events, err := readEvents(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	stats, err := computeStats(r, snapshots, events, idle)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if stats.Kata, err = loadKata(root); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	if jsonOutput {
+		data, err := json.Marshal(stats)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, false)
+			return
+		}
+		writeCommandOut(string(data)+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut(statsTable(stats), projectPath, false)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// LiveStatus is what "live status --format" fills its template with. It is
+// made from the state kept in memory, so that a shell prompt or a tmux
+// status line can ask for it every second.
+type LiveStatus struct {
+	State          string `json:"state"`
+	Project        string `json:"project"`
+	Snapshot       int    `json:"snapshot"`
+	ElapsedSeconds int64  `json:"elapsed_seconds"`
+	Pending        int    `json:"pending"`
+	Paused         bool   `json:"paused"`
+	Build          string `json:"build,omitempty"`
+	BuildName      string `json:"build_name,omitempty"`
+	BuildSummary   string `json:"build_summary,omitempty"`
+}
+
+const STATUS_RECORDING = "recording"
+const STATUS_PAUSED = "paused"
+const STATUS_ARMED = "armed"
+const STATUS_STOPPED = "stopped"
+const STATUS_TIMEOUT = time.Second
+
+var statusMutex sync.Mutex
+var liveStartedAt time.Time
+
+// pendingFiles is the number of files changed since the last snapshot, as
+// seen by the last poll of watch().
+var pendingFiles int
+
+func setPendingFiles(n int) {
+	statusMutex.Lock()
+	pendingFiles = n
+	statusMutex.Unlock()
+}
+
+// Elapsed is the time since the live was started, as h:mm:ss.
+func (s LiveStatus) Elapsed() string {
+	return fmt.Sprintf("%d:%02d:%02d", s.ElapsedSeconds/3600, s.ElapsedSeconds/60%60, s.ElapsedSeconds%60)
+}
+
+func currentLiveStatus(projectPath string) LiveStatus {
+	status := LiveStatus{State: STATUS_STOPPED, Project: projectPath, Snapshot: snapshotID()}
+	if isLiveStarted() {
+		status.State = STATUS_RECORDING
+		if isPaused() {
+			status.State = STATUS_PAUSED
+			status.Paused = true
+		}
+		statusMutex.Lock()
+		status.ElapsedSeconds = int64(time.Since(liveStartedAt).Seconds())
+		status.Pending = pendingFiles
+		statusMutex.Unlock()
+	} else if isArmed() {
+		status.State = STATUS_ARMED
+	}
+	if b := latestBuild(); b != nil {
+		status.Build = "failed"
+		if b.Passed {
+			status.Build = "passed"
+		}
+		status.BuildName = b.Name
+		status.BuildSummary = b.Summary
+	}
+	return status
+}
+
+func formatStatus(status LiveStatus, format string) (string, error) {
+	if format == "" {
+		switch status.State {
+		case STATUS_RECORDING:
+			return "live is started.\n", nil
+		case STATUS_PAUSED:
+			return "live is paused.\n", nil
+		case STATUS_ARMED:
+			return "live is armed.\n", nil
+		}
+		return "live is stopped.\n", nil
+	}
+	t, err := template.New("status").Parse(format)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, status); err != nil {
+		return "", err
+	}
+	return buf.String() + "\n", nil
+}
+
+// findControlSocket looks for the control socket of the project dir is in.
+func findControlSocket(dir string) (string, error) {
+	for {
+		socketPath := liveDataPath(dir, CONTROL_SOCKET)
+		if _, err := os.Stat(socketPath); err == nil {
+			return socketPath, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("no live is running here")
+		}
+		dir = parent
+	}
+}
+
+// requestStatus asks the live running in the project dir is in for its
+// status. A project without a running live is stopped.
+func requestStatus(dir string) (LiveStatus, error) {
+	stopped := LiveStatus{State: STATUS_STOPPED, Project: dir, Snapshot: -1}
+	socketPath, err := findControlSocket(dir)
+	if err != nil {
+		return stopped, nil
+	}
+	conn, err := net.DialTimeout("unix", socketPath, STATUS_TIMEOUT)
+	if err != nil {
+		return stopped, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(STATUS_TIMEOUT))
+
+	if err := json.NewEncoder(conn).Encode(SocketRequest{Type: "status"}); err != nil {
+		return stopped, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return stopped, err
+	}
+	res := SocketResponse{}
+	if err := json.Unmarshal(line, &res); err != nil {
+		return stopped, err
+	}
+	if res.Status == nil {
+		return stopped, errors.New(res.Error)
+	}
+	return *res.Status, nil
+}
+
+// live status [--format template]
+// The prompt splits the template at spaces, so the rest of the line is
+// taken as the template, without the quotes a shell would strip.
+func liveStatus(args []string, line string, projectPath string) {
+	format := ""
+	if len(args) > 1 && args[0] == "--format" {
+		format = unquote(restOfLine(line, 3))
+		args = nil
+	}
+	if len(args) != 0 {
+		writeCommandOut("usage: live status [--format template]\n", projectPath, false)
+		return
+	}
+	out, err := formatStatus(currentLiveStatus(projectPath), format)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeCommandOut(out, projectPath, false)
+}
+
+// statusCommand is "live status" run from another shell, as in
+// "live status --format '{{.Snapshot}}'". It returns the exit code.
+func statusCommand(args []string) int {
+	format := ""
+	if len(args) == 2 && args[0] == "--format" {
+		format = args[1]
+	} else if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: live status [--format template]")
+		return 2
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	status, err := requestStatus(pwd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	out, err := formatStatus(status, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(out)
+	return 0
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// SVGFrame is the visible file at one moment of the session. Focus is the
+// line the view follows when the region is not cropped. Rewrites is the
+// churn of every line, as shown by "live blame".
+type SVGFrame struct {
+	Time     int64
+	ID       int
+	File     string
+	Lines    []string
+	Changed  map[int]bool
+	Focus    int
+	Rewrites []int
+}
+
+type SVGTheme struct {
+	Background string
+	Text       string
+	Muted      string
+	Highlight  string
+}
+
+// SVGOptions are the "live export svg" flags. FirstLine is -1 when the
+// view follows the edits instead of showing a fixed region.
+type SVGOptions struct {
+	Speed     float64
+	MaxIdle   time.Duration
+	Theme     SVGTheme
+	Font      string
+	FontSize  int
+	Rows      int
+	Cols      int
+	FirstLine int
+	File      string
+}
+
+var svgThemes = map[string]SVGTheme{
+	"dark":  {Background: "#1e1e1e", Text: "#d4d4d4", Muted: "#858585", Highlight: "#264f78"},
+	"light": {Background: "#ffffff", Text: "#24292e", Muted: "#999999", Highlight: "#fff5b1"},
+}
+
+const SVG_DEFAULT_SPEED = 10
+const SVG_DEFAULT_FONT = "DejaVu Sans Mono, Menlo, Consolas, monospace"
+const SVG_DEFAULT_FONT_SIZE = 14
+const SVG_DEFAULT_ROWS = 25
+const SVG_DEFAULT_COLS = 80
+const SVG_MIN_FRAME = 50 * time.Millisecond
+const SVG_END_HOLD = 3 * time.Second
+
+// svgFontRegexp is what --font may hold, as it is written into the style
+// sheet as it is.
+var svgFontRegexp = regexp.MustCompile(`^[A-Za-z0-9 ,.-]+$`)
+
+// lineOfRune returns the line the rune at pos is on.
+func lineOfRune(text string, pos int) int {
+	runes := []rune(text)
+	if pos > len(runes) {
+		pos = len(runes)
+	}
+	return strings.Count(string(runes[:pos]), "\n")
+}
+
+// svgFrames picks the file of each snapshot the same way the replay does,
+// and adds a frame for every recorded edit delta leading up to it.
+func svgFrames(r *git.Repository, snapshots Snapshots, events Events, deltas []Delta, file string) ([]SVGFrame, error) {
+	frames := []SVGFrame{}
+	prevFile := ""
+
+	// churn and churnText hold every file shown so far as of the snapshot
+	// before the one being drawn.
+	churn := map[string][]int{}
+	churnText := map[string]string{}
+	trackChurn := func(path string, id int) error {
+		if _, ok := churn[path]; ok || id < 0 {
+			return nil
+		}
+		counts, err := lineChurn(r, snapshots[:id+1], path)
+		if err != nil {
+			return err
+		}
+		text, err := snapshotFile(r, snapshots[id], path)
+		if err != nil {
+			return err
+		}
+		churn[path], churnText[path] = counts, text
+		return nil
+	}
+
+	for id := range snapshots {
+		replay, err := replayFrame(r, snapshots, events, id)
+		if err != nil {
+			return nil, err
+		}
+		frame := SVGFrame{Time: snapshots[id].Time, ID: id, File: replay.File, Lines: replay.Lines, Changed: replay.Changed, Focus: replay.Cursor}
+		if file != "" {
+			frame.File = file
+		} else if frame.File == "" {
+			frame.File = prevFile
+		}
+		if frame.File == "" {
+			continue
+		}
+		if frame.File != replay.File {
+			contents, err := snapshotFile(r, snapshots[id], frame.File)
+			if err != nil {
+				return nil, err
+			}
+			frame.Lines = strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+			frame.Changed = map[int]bool{}
+			frame.Focus = -1
+		}
+		if frame.Focus < 0 {
+			for line := range frame.Changed {
+				if frame.Focus < 0 || line < frame.Focus {
+					frame.Focus = line
+				}
+			}
+		}
+
+		if err := trackChurn(frame.File, id-1); err != nil {
+			return nil, err
+		}
+		if id > 0 {
+			text := ""
+			loaded := false
+			for _, delta := range snapshotDeltas(deltas, id-1) {
+				if delta.File != frame.File {
+					continue
+				}
+				if !loaded {
+					text, err = snapshotFile(r, snapshots[id-1], frame.File)
+					if err != nil {
+						return nil, err
+					}
+					loaded = true
+				}
+				var ok bool
+				if text, ok = replayDelta(text, delta); !ok {
+					continue
+				}
+				focus := 0
+				if len(delta.Ops) > 0 {
+					focus = lineOfRune(text, delta.Ops[len(delta.Ops)-1].Pos)
+				}
+				frames = append(frames, SVGFrame{
+					Time:     delta.Time,
+					ID:       id - 1,
+					File:     frame.File,
+					Lines:    strings.Split(strings.TrimSuffix(text, "\n"), "\n"),
+					Changed:  map[int]bool{focus: true},
+					Focus:    focus,
+					Rewrites: churnStep(churn[frame.File], churnText[frame.File], text),
+				})
+			}
+		}
+
+		for path, prev := range churnText {
+			text, err := snapshotFile(r, snapshots[id], path)
+			if err != nil {
+				return nil, err
+			}
+			if text != prev {
+				churn[path], churnText[path] = churnStep(churn[path], prev, text), text
+			}
+		}
+		if err := trackChurn(frame.File, id); err != nil {
+			return nil, err
+		}
+		frame.Rewrites = churn[frame.File]
+
+		frames = append(frames, frame)
+		prevFile = frame.File
+	}
+	return frames, nil
+}
+
+// svgTimeline returns how long each frame is shown. Gaps are divided by
+// speed and cut to maxIdle, and frames shown for less than SVG_MIN_FRAME
+// are dropped.
+func svgTimeline(frames []SVGFrame, speed float64, maxIdle time.Duration) ([]SVGFrame, []time.Duration) {
+	at := make([]time.Duration, len(frames))
+	for i := 1; i < len(frames); i++ {
+		gap := time.Duration(float64(frames[i].Time-frames[i-1].Time) / speed)
+		if gap < 0 {
+			gap = 0
+		}
+		if maxIdle > 0 && gap > maxIdle {
+			gap = maxIdle
+		}
+		at[i] = at[i-1] + gap
+	}
+
+	kept := []SVGFrame{}
+	keptAt := []time.Duration{}
+	for i := range frames {
+		if i+1 < len(frames) && at[i+1]-at[i] < SVG_MIN_FRAME {
+			continue
+		}
+		kept = append(kept, frames[i])
+		keptAt = append(keptAt, at[i])
+	}
+
+	durations := make([]time.Duration, len(kept))
+	for i := range kept {
+		if i+1 < len(kept) {
+			durations[i] = keptAt[i+1] - keptAt[i]
+		} else {
+			durations[i] = SVG_END_HOLD
+		}
+	}
+	return kept, durations
+}
+
+// svgLine expands tabs, drops control characters and clips line to cols.
+func svgLine(line string, cols int) string {
+	line = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' {
+			return -1
+		}
+		return r
+	}, line)
+	return html.EscapeString(clipLine(line, cols))
+}
+
+// renderSVG draws the frames one under another and animates the strip
+// with CSS steps, so the result only depends on the frames and options.
+func renderSVG(frames []SVGFrame, durations []time.Duration, options SVGOptions) string {
+	lineHeight := float64(options.FontSize) * 1.4
+	charWidth := float64(options.FontSize) * 0.6
+	padding := float64(options.FontSize)
+	gutter := 5
+	width := 2*padding + float64(gutter+options.Cols)*charWidth
+	height := 2*padding + float64(options.Rows+1)*lineHeight
+
+	total := time.Duration(0)
+	for _, d := range durations {
+		total += d
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f">`+"\n", width, height, width, height)
+	b.WriteString("<style>\n")
+	fmt.Fprintf(&b, "text { font-family: %s; font-size: %dpx; white-space: pre; fill: %s; }\n", options.Font, options.FontSize, options.Theme.Text)
+	fmt.Fprintf(&b, ".muted { fill: %s; }\n", options.Theme.Muted)
+	b.WriteString(".heat1 { fill: #2a2; } .heat2 { fill: #cb2; } .heat3 { fill: #d22; }\n")
+	fmt.Fprintf(&b, ".strip { animation: play %.3fs steps(1, end) infinite; }\n", total.Seconds())
+	b.WriteString("@keyframes play {\n")
+	at := time.Duration(0)
+	for i, d := range durations {
+		fmt.Fprintf(&b, "  %.3f%% { transform: translateY(%.1fpx); }\n", 100*at.Seconds()/total.Seconds(), float64(-i)*height)
+		at += d
+	}
+	fmt.Fprintf(&b, "  100%% { transform: translateY(%.1fpx); }\n", float64(1-len(durations))*height)
+	b.WriteString("}\n</style>\n")
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", options.Theme.Background)
+	b.WriteString(`<g class="strip">` + "\n")
+
+	for i, frame := range frames {
+		top := float64(i) * height
+		first := options.FirstLine
+		if first < 0 {
+			first = 0
+			if frame.Focus >= options.Rows/2 {
+				first = frame.Focus - options.Rows/2
+			}
+			if first > len(frame.Lines)-options.Rows {
+				first = len(frame.Lines) - options.Rows
+			}
+			if first < 0 {
+				first = 0
+			}
+		}
+
+		fmt.Fprintf(&b, `<g transform="translate(0 %.1f)">`+"\n", top)
+		// the time since the first frame, which reads the same in every
+		// time zone
+		header := frame.File + "  ID " + strconv.Itoa(frame.ID) + "  +" + formatSeconds(float64(frame.Time-frames[0].Time)/1e9)
+		fmt.Fprintf(&b, `<text class="muted" x="%.1f" y="%.1f">%s</text>`+"\n", padding, padding+lineHeight*0.8, svgLine(header, gutter+options.Cols))
+		for row := 0; row < options.Rows && first+row < len(frame.Lines); row++ {
+			line := first + row
+			y := padding + float64(row+1)*lineHeight
+			if frame.Changed[line] {
+				fmt.Fprintf(&b, `<rect x="0" y="%.1f" width="%.0f" height="%.1f" fill="%s"/>`+"\n", y+lineHeight*0.15, width, lineHeight, options.Theme.Highlight)
+			}
+			gutterClass := "muted"
+			if line < len(frame.Rewrites) && heatLevel(frame.Rewrites[line]) > 0 {
+				gutterClass = "heat" + strconv.Itoa(heatLevel(frame.Rewrites[line]))
+			}
+			fmt.Fprintf(&b, `<text class="%s" x="%.1f" y="%.1f">%4d</text>`, gutterClass, padding, y+lineHeight*0.8, line+1)
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.1f">%s</text>`+"\n", padding+float64(gutter)*charWidth, y+lineHeight*0.8, svgLine(frame.Lines[line], options.Cols))
+		}
+		b.WriteString("</g>\n")
+	}
+	b.WriteString("</g>\n</svg>\n")
+	return b.String()
+}
+
+// parseLineRange parses "a-b", the 1-based first and last line to show.
+func parseLineRange(value string) (int, int, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("--lines must look like 10-40")
+	}
+	first, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.New("--lines must look like 10-40")
+	}
+	last, err := strconv.Atoi(parts[1])
+	if err != nil || first < 1 || last < first {
+		return 0, 0, errors.New("--lines must look like 10-40")
+	}
+	return first, last, nil
+}
+
+func svgOptions(args []string) (SVGOptions, []string, string, error) {
+	options := SVGOptions{
+		Speed:     SVG_DEFAULT_SPEED,
+		MaxIdle:   REPLAY_MAX_GAP,
+		Theme:     svgThemes["dark"],
+		Font:      SVG_DEFAULT_FONT,
+		FontSize:  SVG_DEFAULT_FONT_SIZE,
+		Rows:      SVG_DEFAULT_ROWS,
+		Cols:      SVG_DEFAULT_COLS,
+		FirstLine: -1,
+	}
+
+	args, outputPath, _ := flagValue(args, "-o")
+	args, value, ok := flagValue(args, "--speed")
+	if ok {
+		speed, err := strconv.ParseFloat(value, 64)
+		if err != nil || speed <= 0 {
+			return options, nil, "", errors.New("--speed must be a positive number")
+		}
+		options.Speed = speed
+	}
+	args, value, ok = flagValue(args, "--max-idle")
+	if ok {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			return options, nil, "", errors.New("--max-idle must be a number of seconds")
+		}
+		options.MaxIdle = time.Duration(seconds * float64(time.Second))
+	}
+	args, value, ok = flagValue(args, "--theme")
+	if ok {
+		theme, found := svgThemes[value]
+		if !found {
+			return options, nil, "", errors.New("--theme must be dark or light")
+		}
+		options.Theme = theme
+	}
+	// the shell splits on spaces, so "_" stands for a space in font names
+	args, value, ok = flagValue(args, "--font")
+	if ok {
+		options.Font = strings.Replace(value, "_", " ", -1)
+		if !svgFontRegexp.MatchString(options.Font) {
+			return options, nil, "", errors.New("--font must be font names separated by commas")
+		}
+	}
+	args, value, ok = flagValue(args, "--font-size")
+	if ok {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return options, nil, "", errors.New("--font-size must be a positive number")
+		}
+		options.FontSize = size
+	}
+	args, value, ok = flagValue(args, "--cols")
+	if ok {
+		cols, err := strconv.Atoi(value)
+		if err != nil || cols <= 0 {
+			return options, nil, "", errors.New("--cols must be a positive number")
+		}
+		options.Cols = cols
+	}
+	args, value, ok = flagValue(args, "--lines")
+	if ok {
+		first, last, err := parseLineRange(value)
+		if err != nil {
+			return options, nil, "", err
+		}
+		options.FirstLine = first - 1
+		options.Rows = last - first + 1
+	}
+	args, value, ok = flagValue(args, "--file")
+	if ok {
+		// a path in the snapshots, so that it means the same with --session
+		file := path.Clean(filepath.ToSlash(value))
+		if filepath.IsAbs(value) || file == ".." || strings.HasPrefix(file, "../") {
+			return options, nil, "", errors.New("--file must be a path relative to the project root")
+		}
+		options.File = file
+	}
+	return options, args, outputPath, nil
+}
+
+// live export svg -o file [--speed n] [--max-idle seconds] [--theme dark|light]
+// [--font name] [--font-size n] [--cols n] [--lines a-b] [--file path]
+func exportSVG(args []string, projectPath string) {
+	usage := "usage: live export svg -o file [--speed n] [--max-idle seconds] [--theme dark|light] [--font name] [--font-size n] [--cols n] [--lines a-b] [--file path]\n"
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	options, args, outputPath, err := svgOptions(args)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if len(args) != 0 || outputPath == "" {
+		writeCommandOut(usage, projectPath, false)
+		return
+	}
+
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	events, err := readEvents(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	deltas, err := loadDeltas(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	frames, err := svgFrames(r, snapshots, events, deltas, options.File)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	if len(frames) == 0 {
+		writeCommandOut("there is no file to show.\n", projectPath, false)
+		return
+	}
+	frames, durations := svgTimeline(frames, options.Speed, options.MaxIdle)
+	writeExport(renderSVG(frames, durations, options), outputPath, projectPath)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// TerminalBlock is one command of the terminal log with the output that
+// followed it.
+type TerminalBlock struct {
+	Command string
+	Output  string
+}
+
+const DEFAULT_TUTORIAL_DIFF_LINES = 80
+const TUTORIAL_OUTPUT_LINES = 10
+
+func terminalBlocks(terminal string) []TerminalBlock {
+	blocks := []TerminalBlock{}
+	for _, line := range strings.SplitAfter(terminal, "\n") {
+		if strings.HasPrefix(line, "$ ") {
+			blocks = append(blocks, TerminalBlock{Command: strings.TrimSuffix(line[2:], "\n")})
+			continue
+		}
+		if len(blocks) > 0 {
+			blocks[len(blocks)-1].Output += line
+		}
+	}
+	return blocks
+}
+
+// snapshotRangePatch is the cumulative patch from snapshot from to snapshot
+// to, without the terminal log. A from of -1 is the empty tree.
+func snapshotRangePatch(r *git.Repository, snapshots Snapshots, from int, to int) (*object.Patch, error) {
+	var fromTree *object.Tree
+	if from >= 0 {
+		c, err := snapshotCommit(r, snapshots[from])
+		if err != nil {
+			return nil, err
+		}
+		fromTree, err = c.Tree()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c, err := snapshotCommit(r, snapshots[to])
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+	files := object.Changes{}
+	for _, change := range changes {
+		if change.From.Name != CUI_LOG && change.To.Name != CUI_LOG {
+			files = append(files, change)
+		}
+	}
+	return files.Patch()
+}
+
+func trimOutput(out string, max int) string {
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) <= max {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(lines[:max], "\n") + "\n... (" + strconv.Itoa(len(lines)-max) + " more lines)"
+}
+
+// codeFence returns a fence longer than any run of backticks in text.
+func codeFence(text string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence
+}
+
+func codeBlock(text string, lang string) string {
+	fence := codeFence(text)
+	return fence + lang + "\n" + text + "\n" + fence + "\n\n"
+}
+
+// tutorialSection renders what happened between two markers: the notes,
+// the commands with their output, and the diff over the range.
+func tutorialSection(r *git.Repository, snapshots Snapshots, events Events, blocks []TerminalBlock, next *int, sr SnapshotRange, maxDiffLines int) (string, error) {
+	out := "## " + sr.Title + "\n\n"
+
+	for _, e := range events {
+		if e.Type == "note" && e.Time > sr.Since && e.Time <= sr.Until {
+			out += e.Label + "\n\n"
+		}
+	}
+
+	commands := ""
+	for _, e := range events {
+		if e.Type != "command" || e.Time <= sr.Since || e.Time > sr.Until {
+			continue
+		}
+		output := ""
+		for i := *next; i < len(blocks); i++ {
+			if blocks[i].Command == e.Command {
+				output = blocks[i].Output
+				*next = i + 1
+				break
+			}
+		}
+		commands += "$ " + e.Command + "\n"
+		if strings.TrimSpace(output) != "" {
+			commands += trimOutput(output, TUTORIAL_OUTPUT_LINES) + "\n"
+		}
+		if e.ExitCode != 0 {
+			commands += "(exit status " + strconv.Itoa(e.ExitCode) + ")\n"
+		}
+	}
+	if commands != "" {
+		out += "### Commands\n\n" + codeBlock(strings.TrimSuffix(commands, "\n"), "console")
+	}
+
+	if sr.To < 0 || sr.To <= sr.From {
+		return out, nil
+	}
+	patch, err := snapshotRangePatch(r, snapshots, sr.From, sr.To)
+	if err != nil {
+		return "", err
+	}
+	changed, lines := patchLines(patch)
+	if len(changed) == 0 {
+		return out, nil
+	}
+	out += "### Changes\n\n"
+	if len(lines) <= maxDiffLines {
+		return out + codeBlock(strings.Join(lines, "\n"), "diff"), nil
+	}
+	for _, stat := range patch.Stats() {
+		out += fmt.Sprintf("- `%s` +%d -%d\n", stat.Name, stat.Addition, stat.Deletion)
+	}
+	return out + "\n", nil
+}
+
+// SnapshotRange is the part of a session between two markers: the events
+// after Since up to Until, and the snapshots after From up to To.
+type SnapshotRange struct {
+	Title string
+	Since int64
+	Until int64
+	From  int
+	To    int
+}
+
+// markerRanges splits the session at every marker, with a last range for
+// what came after the last marker. The first range starts from nothing,
+// with From -1.
+func markerRanges(snapshots Snapshots, markers []Marker, last string) []SnapshotRange {
+	ranges := []SnapshotRange{}
+	since := int64(0)
+	from := -1
+	for _, m := range markers {
+		ranges = append(ranges, SnapshotRange{Title: m.Label, Since: since, Until: m.Time, From: from, To: m.Snapshot})
+		since = m.Time
+		if m.Snapshot > from {
+			from = m.Snapshot
+		}
+	}
+	latest := len(snapshots) - 1
+	if latest > from {
+		ranges = append(ranges, SnapshotRange{Title: last, Since: since, Until: snapshots[latest].Time, From: from, To: latest})
+	}
+	return ranges
+}
+
+// tutorialMarkdown turns a session into a Markdown document with a section
+// for every marker, and a last one for what came after the last marker.
+func tutorialMarkdown(r *git.Repository, root string, snapshots Snapshots, events Events, maxDiffLines int) (string, error) {
+	markers := sessionMarkers(events)
+	if len(markers) == 0 {
+		return "", errors.New("there are no markers, add some with \"live mark <label>\"")
+	}
+
+	terminal, err := snapshotFile(r, snapshots[len(snapshots)-1], CUI_LOG)
+	if err != nil {
+		return "", err
+	}
+	blocks := terminalBlocks(terminal)
+	next := 0
+
+	out := "# " + filepath.Base(root) + "\n\n"
+	out += "_Recorded on " + time.Unix(0, snapshots[0].Time).Format("2006-01-02") + "._\n\n"
+
+	for _, sr := range markerRanges(snapshots, markers, "Wrapping up") {
+		section, err := tutorialSection(r, snapshots, events, blocks, &next, sr, maxDiffLines)
+		if err != nil {
+			return "", err
+		}
+		out += section
+	}
+	return strings.TrimSuffix(out, "\n"), nil
+}
+
+// live export tutorial [--max-diff-lines n] [-o file]
+func exportTutorial(args []string, projectPath string) {
+	args, maxValue, _ := flagValue(args, "--max-diff-lines")
+	args, outputPath, _ := flagValue(args, "-o")
+	if len(args) != 0 {
+		writeCommandOut("usage: live export tutorial [--max-diff-lines n] [-o file]\n", projectPath, false)
+		return
+	}
+
+	r, root, err := openLiveRepository(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	snapshots, err := loadSnapshotIndex(r, root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	events, err := readEvents(root)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+
+	config, err := loadProjectConfig(root)
+	if err != nil {
+		writeCommandOut(PROJECT_CONFIG+": "+err.Error()+"\n", projectPath, false)
+		return
+	}
+	maxDiffLines := config.Export.MaxDiffLines
+	if maxDiffLines <= 0 {
+		maxDiffLines = DEFAULT_TUTORIAL_DIFF_LINES
+	}
+	if maxValue != "" {
+		maxDiffLines, err = strconv.Atoi(maxValue)
+		if err != nil {
+			writeCommandOut("--max-diff-lines must be a number\n", projectPath, false)
+			return
+		}
+	}
+
+	out, err := tutorialMarkdown(r, root, snapshots, events, maxDiffLines)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, false)
+		return
+	}
+	writeExport(out+"\n", outputPath, projectPath)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+// live upload <path>, where path is a project or a .livesession archive
+func liveUpload(path string, projectPath string) {
+	if isLiveStarted() {
+		writeCommandOut("you should stop live before.\n", projectPath, false)
+		return
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+
+	if _, err := os.Stat(absPath); os.IsNotExist(err) {
+		writeCommandOut("File doesn't exists\n", projectPath, isLiveStarted())
+		return
+	}
+
+	projectPath = absPath
+	if isSessionArchive(absPath) {
+		dir, cleanup, err := unpackSessionTemp(absPath)
+		if err != nil {
+			writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+			return
+		}
+		defer cleanup()
+		projectPath = dir
+	}
+
+	r, err := git.PlainOpen(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+	if err := syncGitView(r, projectPath); err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+
+	userConfig, err := loggedInUser()
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+
+	publishPath, ok, err := preparePublish(projectPath)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+	if !ok {
+		return
+	}
+
+	writeCommandOut("preparing to upload ...\n", projectPath, isLiveStarted())
+
+	projectName := filepath.Base(projectPath)
+
+	prevDir, err := filepath.Abs(".")
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+
+	// compress works on relative paths; the working directory is restored
+	// before publishPath is removed, whether or not it succeeds
+	var buf bytes.Buffer
+	err = func() error {
+		if err := os.Chdir(publishPath); err != nil {
+			return err
+		}
+		defer os.Chdir(prevDir)
+		return compress(".git", &buf)
+	}()
+	if publishPath != projectPath {
+		os.RemoveAll(publishPath)
+	}
+	if err != nil {
+		writeCommandOut("compress .git-directory failed: "+err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+
+	writeCommandOut("uploading ...\n", projectPath, isLiveStarted())
+
+	bodyBytes, err := apiRequest(userConfig, "POST", "/api/live/upload?projectName="+url.QueryEscape(projectName), &buf, "application/gzip")
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+	uploadsResponse := UploadsResponse{}
+	err = json.Unmarshal(bodyBytes, &uploadsResponse)
+	if err != nil {
+		writeCommandOut(err.Error()+"\n", projectPath, isLiveStarted())
+		return
+	}
+
+	if len(uploadsResponse) != 1 {
+		writeCommandOut("upload response is invalid\n", projectPath, isLiveStarted())
+		return
+	}
+	uploadedURL := uploadsResponse[0].URL
+	writeCommandOut("done!\n", projectPath, isLiveStarted())
+	writeCommandOut("you can see your live-coding in \""+uploadedURL+"\"\n", projectPath, isLiveStarted())
+}